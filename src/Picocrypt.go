@@ -13,21 +13,21 @@ https://github.com/HACKERALERT/Picocrypt
 
 import (
 	"archive/zip"
-	"bytes"
-	"crypto/cipher"
-	"crypto/hmac"
 	"crypto/rand"
-	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"hash"
 	"image"
 	"image/color"
 	"io"
 	"math"
 	"math/big"
 	"os"
+	"os/signal"
 	"path/filepath"
-	"regexp"
 	"runtime"
 	"strconv"
 	"strings"
@@ -35,17 +35,12 @@ import (
 	"time"
 
 	"github.com/HACKERALERT/clipboard"
-	"github.com/HACKERALERT/crypto/argon2"
-	"github.com/HACKERALERT/crypto/blake2b"
-	"github.com/HACKERALERT/crypto/chacha20"
-	"github.com/HACKERALERT/crypto/hkdf"
-	"github.com/HACKERALERT/crypto/sha3"
 	"github.com/HACKERALERT/dialog"
 	"github.com/HACKERALERT/giu"
 	"github.com/HACKERALERT/imgui-go"
-	"github.com/HACKERALERT/infectious"
-	"github.com/HACKERALERT/serpent"
 	"github.com/HACKERALERT/zxcvbn-go"
+
+	"Picocrypt/volume"
 )
 
 // Constants
@@ -61,7 +56,6 @@ var TRANSPARENT = color.RGBA{0x00, 0x00, 0x00, 0x00}
 
 // Generic variables
 var window *giu.MasterWindow
-var version = "v1.30"
 var dpi float32
 var mode string
 var working bool
@@ -73,11 +67,12 @@ var showPassgen bool
 var showKeyfile bool
 var showOverwrite bool
 var showProgress bool
+var showNotes bool
 
 // Input and output files
 var inputFile string
-var inputFileOld string
 var outputFile string
+var outputCustom bool // The output was chosen, so it isn't renamed from the metadata
 var onlyFiles []string
 var onlyFolders []string
 var allFiles []string
@@ -104,22 +99,58 @@ var keyfiles []string
 var keyfileOrdered bool
 var keyfileLabel = "None selected."
 
+// Public keys to encrypt to and private keys to decrypt with (command line only)
+var recipients [][]byte
+var identities [][]byte
+
+// More passwords that can decrypt, each in its own key slot (command line only)
+var extraKeys []volume.Key
+
+// Labels stored in the header without encryption (command line only)
+var tags []volume.Tag
+
+// Ed25519 key to sign volumes with, and whether to save the signature separately (command line only)
+var signingKey []byte
+var detached bool
+
+// Random padding and a file to hide at its end, opened with its own password (command line only)
+var padding int64
+var hiddenFile string
+var hiddenPassword string
+
 // Comments variables
 var comments string
 var commentsLabel = "Comments:"
 var commentsDisabled bool
 
+// Encrypted comments, which are only shown after decrypting
+var notes string
+var revealedNotes string
+
 // Advanced options
 var paranoid bool
 var reedsolo bool
+var parityLevels = []string{"6%", "12%", "25%", "50%"}
+var paritySelected int32
 var split bool
 var splitSize string
 var splitUnits = []string{"KiB", "MiB", "GiB", "TiB", "Total"}
 var splitSelected int32 = 1
+var argon2Presets = []string{"Default", "Low memory", "Strong"}
+var argon2Selected int32
+var argon2Custom *volume.Argon2 // Set from the command line
+var hideSize bool
+var padScheme int // Set from the command line
+var randomName bool
+var recovery bool
+var recoveryPercent = 10 // Set from the command line
+var recoveryChunks int   // Set from the command line, otherwise based on recoveryPercent
 var recombine bool
 var compress bool
 var delete bool
 var keep bool
+var repair bool
+var rebuildChunks bool
 var kept bool
 
 // Status variables
@@ -128,6 +159,21 @@ var mainStatus = "Ready."
 var mainStatusColor = WHITE
 var popupStatus string
 
+// Exit codes when running from the command line
+const (
+	exitSuccess   = iota // Completed
+	exitFailure          // Generic failure (not a volume, output exists, etc.)
+	exitUsage            // Invalid command-line arguments
+	exitAccess           // Read or write access denied
+	exitSpace            // Insufficient disk space
+	exitIncorrect        // Incorrect password or keyfiles
+	exitDamaged          // Volume is damaged or modified
+	exitModified         // Force decrypted, but the volume was modified
+	exitCancelled        // Interrupted by the user
+)
+
+var exitCode int
+
 // Progress variables
 var progress float32
 var progressInfo string
@@ -135,14 +181,6 @@ var speed float64
 var eta string
 var canCancel bool
 
-// Reed-Solomon encoders
-var rs1, _ = infectious.NewFEC(1, 3)
-var rs5, _ = infectious.NewFEC(5, 15)
-var rs16, _ = infectious.NewFEC(16, 48)
-var rs24, _ = infectious.NewFEC(24, 72)
-var rs32, _ = infectious.NewFEC(32, 96)
-var rs64, _ = infectious.NewFEC(64, 192)
-var rs128, _ = infectious.NewFEC(128, 136)
 var fastDecode bool
 
 // Compression variables and passthrough
@@ -164,12 +202,55 @@ func (p *compressorProgress) Read(data []byte) (int, error) {
 	if compress {
 		popupStatus = fmt.Sprintf("Compressing at %.2f MiB/s (ETA: %s)", speed, eta)
 	} else {
-		popupStatus = fmt.Sprintf("Combining at %.2f MiB/s (ETA: %s)", speed, eta)
+		popupStatus = fmt.Sprintf("Encrypting at %.2f MiB/s (ETA: %s)", speed, eta)
+	}
+	update()
+	return read, err
+}
+
+// Passthrough to report progress while encrypting or decrypting
+type workProgress struct {
+	io.Reader
+	done   int64
+	total  int64
+	header int64 // Reading the header isn't shown as progress
+	start  time.Time
+}
+
+func (p *workProgress) Read(data []byte) (int, error) {
+	if !working {
+		return 0, io.EOF
+	}
+	read, err := p.Reader.Read(data)
+	p.done += int64(read)
+	if p.done <= p.header {
+		return read, err
+	}
+	progress, speed, eta = statify(p.done-p.header, p.total-p.header, p.start)
+	progressInfo = fmt.Sprintf("%.2f%%", progress*100)
+	if mode == "encrypt" {
+		popupStatus = fmt.Sprintf("Encrypting at %.2f MiB/s (ETA: %s)", speed, eta)
+	} else if fastDecode {
+		popupStatus = fmt.Sprintf("Decrypting at %.2f MiB/s (ETA: %s)", speed, eta)
+	} else {
+		popupStatus = fmt.Sprintf("Repairing at %.2f MiB/s (ETA: %s)", speed, eta)
 	}
-	giu.Update()
+	update()
 	return read, err
 }
 
+// Where work() reads from, either a file or the chunks of a split volume
+type input interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// Where work() writes to, either a file or the chunks of a split volume
+type output interface {
+	io.WriteSeeker
+	io.Closer
+}
+
 // The main user interface
 func draw() {
 	giu.SingleWindow().Flags(524351).Layout(
@@ -278,6 +359,24 @@ func draw() {
 				giu.Update()
 			}
 
+			if showNotes {
+				giu.PopupModal("Notes:##"+strconv.Itoa(modalId)).Flags(6).Layout(
+					giu.InputText(&revealedNotes).Size(300).Flags(giu.InputTextFlagsReadOnly),
+					giu.Row(
+						giu.Button("Copy").Size(100, 0).OnClick(func() {
+							clipboard.WriteAll(revealedNotes)
+						}),
+						giu.Button("Close").Size(100, 0).OnClick(func() {
+							giu.CloseCurrentPopup()
+							showNotes = false
+							revealedNotes = ""
+						}),
+					),
+				).Build()
+				giu.OpenPopup("Notes:##" + strconv.Itoa(modalId))
+				giu.Update()
+			}
+
 			if showProgress {
 				giu.PopupModal(" ##"+strconv.Itoa(modalId)).Flags(6).Layout(
 					giu.Row(
@@ -451,7 +550,8 @@ func draw() {
 							_, err = fout.Write(data)
 							fout.Close()
 							if err != nil {
-								insufficientSpace(nil, nil)
+								mainStatus, exitCode = volumeError(err)
+								mainStatusColor = RED
 								os.Remove(file)
 							} else {
 								mainStatus = "Ready."
@@ -478,6 +578,13 @@ func draw() {
 					return giu.InputTextFlagsNone
 				}()),
 			),
+			giu.Custom(func() {
+				if mode != "decrypt" {
+					giu.Label("Notes (encrypted):").Build()
+					giu.InputText(&notes).Size(giu.Auto).Build()
+					giu.Tooltip("Stored encrypted with the data and only shown after decrypting.").Build()
+				}
+			}),
 		),
 		giu.Style().SetDisabled((len(keyfiles) == 0 && password == "") || (mode == "encrypt" && password != cpassword)).To(
 			giu.Label("Advanced:"),
@@ -488,7 +595,7 @@ func draw() {
 						giu.Tooltip("Provides the highest level of security attainable."),
 						giu.Dummy(-170, 0),
 						giu.Checkbox("Compress files", &compress).OnChange(func() {
-							if !(len(allFiles) > 1 || len(onlyFolders) > 0) {
+							if !(len(allFiles) > 1 || len(onlyFolders) > 0) && !randomName {
 								if compress {
 									outputFile = filepath.Join(filepath.Dir(outputFile), "Encrypted") + ".zip.pcv"
 								} else {
@@ -507,6 +614,16 @@ func draw() {
 						giu.Tooltip("Delete the input files after encryption."),
 					).Build()
 
+					giu.Style().SetDisabled(!reedsolo).To(
+						giu.Row(
+							giu.Label("Redundancy:"),
+							giu.Tooltip("Choose how much Reed-Solomon parity to add."),
+							giu.Dummy(-170, 0),
+							giu.Combo("##parity", parityLevels[paritySelected], parityLevels, &paritySelected).Size(giu.Auto),
+							giu.Tooltip("More parity can correct more damage: 6% corrects 4 bytes in every 136, 50% corrects 32 in every 192."),
+						),
+					).Build()
+
 					giu.Row(
 						giu.Checkbox("Split into chunks:", &split),
 						giu.Tooltip("Split the output file into smaller chunks."),
@@ -518,6 +635,36 @@ func draw() {
 						giu.Combo("##splitter", splitUnits[splitSelected], splitUnits, &splitSelected).Size(68),
 						giu.Tooltip("Choose the chunk units."),
 					).Build()
+
+					giu.Row(
+						giu.Label("Key derivation:"),
+						giu.Tooltip("Choose how much memory Argon2 uses to derive keys."),
+						giu.Dummy(-170, 0),
+						giu.Combo("##argon2", argon2Presets[argon2Selected], argon2Presets, &argon2Selected).Size(giu.Auto),
+						giu.Tooltip("Default uses 1 GiB, Low memory 256 MiB, and Strong 2 GiB."),
+					).Build()
+
+					giu.Row(
+						giu.Checkbox("Hide file size", &hideSize),
+						giu.Tooltip("Pad the volume so its size doesn't reveal the exact size of the files."),
+						giu.Dummy(-170, 0),
+						giu.Checkbox("Random name", &randomName).OnChange(func() {
+							if randomName {
+								outputFile = randomOutput(outputFile)
+							} else if compress && !(len(allFiles) > 1 || len(onlyFolders) > 0) {
+								outputFile = filepath.Join(filepath.Dir(outputFile), "Encrypted") + ".zip.pcv"
+							} else {
+								outputFile = filepath.Join(filepath.Dir(outputFile), filepath.Base(inputFile)) + ".pcv"
+							}
+						}),
+						giu.Tooltip("Give the volume a random name. The original name is restored when decrypting."),
+					).Build()
+
+					giu.Row(
+						giu.Checkbox("Recovery file", &recovery),
+						giu.Tooltip("Also save a .parity file that can rebuild up to 10% of the volume if it's damaged or cut short.\n"+
+							"When splitting, add a parity chunk for every 10 chunks instead, so that many lost chunks can be rebuilt."),
+					).Build()
 				} else {
 					giu.Row(
 						giu.Checkbox("Force decrypt", &keep),
@@ -526,6 +673,14 @@ func draw() {
 						giu.Checkbox("Delete volume", &delete),
 						giu.Tooltip("Delete the volume after a successful decryption."),
 					).Build()
+
+					giu.Row(
+						giu.Checkbox("Rebuild chunks", &rebuildChunks),
+						giu.Tooltip("Rebuild lost or damaged chunks of a split volume from its parity chunks."),
+						giu.Dummy(-170, 0),
+						giu.Checkbox("Repair volume", &repair),
+						giu.Tooltip("If the volume had to be corrected with Reed-Solomon, write the corrections back to it."),
+					).Build()
 				}
 			}),
 
@@ -590,6 +745,8 @@ func draw() {
 						}
 					}
 					outputFile = file
+					outputCustom = true
+					randomName = false
 					mainStatus = "Ready."
 					mainStatusColor = WHITE
 				}).Build()
@@ -617,8 +774,7 @@ func draw() {
 
 				// Check if any split chunks already exist
 				if split {
-					names, _ := filepath.Glob(outputFile + ".*")
-					if len(names) > 0 {
+					if chunksExist(outputFile) {
 						err = nil
 					} else {
 						err = os.ErrNotExist
@@ -676,7 +832,7 @@ func onDrop(names []string) {
 				showKeyfile = false
 				resetUI()
 				accessDenied("Keyfile read")
-				giu.Update()
+				update()
 				return
 			}
 			if !duplicate && !stat.IsDir() && err == nil {
@@ -695,7 +851,7 @@ func onDrop(names []string) {
 		}
 
 		modalId++
-		giu.Update()
+		update()
 		return
 	}
 
@@ -761,71 +917,76 @@ func onDrop(names []string) {
 				}
 
 				// Open the input file in read-only mode
-				var fin *os.File
+				var fin io.ReadCloser
 				var err error
 				if isSplit {
-					fin, err = os.Open(names[0] + ".0")
+					fin, err = volume.NewSplitReader(names[0])
 				} else {
 					fin, err = os.Open(names[0])
 				}
+				// Lost chunks can be rebuilt when decrypting if there are parity chunks
+				missing := false
+				if err == volume.ErrChunkMissing {
+					if _, perr := os.Stat(inputFile + ".p0"); perr != nil {
+						resetUI()
+						mainStatus, exitCode = volumeError(err)
+						mainStatusColor = RED
+						return
+					}
+					missing, err = true, nil
+				}
 				if err != nil {
 					resetUI()
 					accessDenied("Read")
 					return
 				}
 
-				// Use regex to test if the input is a valid Picocrypt volume
-				tmp := make([]byte, 15)
-				fin.Read(tmp)
-				tmp, err = rsDecode(rs5, tmp)
-				if valid, _ := regexp.Match(`^v\d\.\d{2}`, tmp); !valid || err != nil {
+				// Read the header and test if the input is a valid Picocrypt volume
+				var header *volume.Header
+				if missing {
+					header, err = splitHeader(inputFile)
+				} else {
+					header, err = volume.ReadHeader(fin)
+					fin.Close()
+				}
+				if header == nil && missing {
+					mainStatus = "The first chunk is missing. Check \"Rebuild chunks\" to rebuild it."
+					mainStatusColor = YELLOW
+					keyfileLabel = "Not applicable."
+					return
+				}
+				if header == nil {
 					resetUI()
 					mainStatus = "This doesn't seem like a Picocrypt volume."
 					mainStatusColor = RED
-					fin.Close()
+					exitCode = exitFailure
 					return
 				}
 
-				// Read comments from file and check for corruption
-				tmp = make([]byte, 15)
-				fin.Read(tmp)
-				tmp, err = rsDecode(rs5, tmp)
-				if err == nil {
-					commentsLength, _ := strconv.Atoi(string(tmp))
-					tmp = make([]byte, commentsLength*3)
-					fin.Read(tmp)
-					comments = ""
-					for i := 0; i < commentsLength*3; i += 3 {
-						t, err := rsDecode(rs1, tmp[i:i+3])
-						if err != nil {
-							comments = "Comments are corrupted."
-							break
-						}
-						comments += string(t)
-					}
-				} else {
+				// Show the comments and check for corruption
+				comments = header.Comments
+				if header.CommentsDamaged {
 					comments = "Comments are corrupted."
 				}
 
-				// Read flags from file and check for corruption
-				flags := make([]byte, 15)
-				fin.Read(flags)
-				fin.Close()
-				flags, err = rsDecode(rs5, flags)
+				// The volume can still be force decrypted if the header is damaged
 				if err != nil {
 					mainStatus = "The volume header is damaged."
 					mainStatusColor = RED
-					return
+					exitCode = exitDamaged
+				} else if missing {
+					mainStatus = "Chunks are missing. Check \"Rebuild chunks\" to rebuild them."
+					mainStatusColor = YELLOW
 				}
 
 				// Update UI and variables according to flags
-				if flags[1] == 1 {
+				if header.Keyfiles {
 					keyfile = true
 					keyfileLabel = "Keyfiles required."
 				} else {
 					keyfileLabel = "Not applicable."
 				}
-				if flags[2] == 1 {
+				if header.KeyfileOrdered {
 					keyfileOrdered = true
 				}
 			} else { // One file was dropped for encryption
@@ -860,7 +1021,7 @@ func onDrop(names []string) {
 
 				compressTotal += stat.Size()
 				inputLabel = fmt.Sprintf("Scanning files... (%s)", sizeify(compressTotal))
-				giu.Update()
+				update()
 			}
 		}
 
@@ -897,14 +1058,14 @@ func onDrop(names []string) {
 					allFiles = append(allFiles, path)
 					compressTotal += stat.Size()
 					inputLabel = fmt.Sprintf("Scanning files... (%s)", sizeify(compressTotal))
-					giu.Update()
+					update()
 				}
 				return nil
 			})
 		}
 		inputLabel = fmt.Sprintf("%s (%s)", oldInputLabel, sizeify(compressTotal))
 		scanning = false
-		giu.Update()
+		update()
 	}()
 }
 
@@ -912,874 +1073,351 @@ func work() {
 	popupStatus = "Starting..."
 	mainStatus = "Working..."
 	mainStatusColor = WHITE
+	exitCode = exitSuccess
 	working = true
-	padded := false
-	giu.Update()
-
-	// Cryptography values
-	var salt []byte                    // Argon2 salt, 16 bytes
-	var hkdfSalt []byte                // HKDF-SHA3 salt, 32 bytes
-	var serpentIV []byte               // Serpent IV, 16 bytes
-	var nonce []byte                   // 24-byte XChaCha20 nonce
-	var keyHash []byte                 // SHA3-512 hash of encryption key
-	var keyHashRef []byte              // Same as 'keyHash', but used for comparison
-	var keyfileKey []byte              // The SHA3-256 hashes of keyfiles
-	var keyfileHash = make([]byte, 32) // The SHA3-256 of 'keyfileKey'
-	var keyfileHashRef []byte          // Same as 'keyfileHash', but used for comparison
-	var authTag []byte                 // 64-byte authentication tag (BLAKE2b or HMAC-SHA3)
-
-	// Combine/compress all files into a .zip file if needed
-	if len(allFiles) > 1 || len(onlyFolders) > 0 || compress {
-		// Consider case where compressing only one file
-		files := allFiles
-		if len(allFiles) == 0 {
-			files = onlyFiles
-		}
-
-		// Get the root directory of the selected files
-		var rootDir string
-		if len(onlyFolders) > 0 {
-			rootDir = filepath.Dir(onlyFolders[0])
-		} else {
-			rootDir = filepath.Dir(onlyFiles[0])
-		}
-
-		// Open a temporary .zip for writing
-		file, err := os.CreateTemp("", "*.zip")
-		if err != nil { // Error, fall back to output folder
-			inputFile = strings.TrimSuffix(outputFile, ".pcv")
-			file, err = os.Create(inputFile)
-		} else { // No issues, use the temporary .zip
-			inputFile = file.Name()
-		}
-		if err != nil { // Make sure file is writable
-			accessDenied("Write")
-			return
-		}
-
-		// Add each file to the .zip
-		writer := zip.NewWriter(file)
-		compressStart = time.Now()
-		for i, path := range files {
-			progressInfo = fmt.Sprintf("%d/%d", i+1, len(files))
-			giu.Update()
-
-			// Create file info header (size, last modified, etc.)
-			stat, err := os.Stat(path)
-			if err != nil {
-				continue // Skip temporary and inaccessible files
-			}
-			header, _ := zip.FileInfoHeader(stat)
-			header.Name = strings.TrimPrefix(path, rootDir)
-			header.Name = filepath.ToSlash(header.Name)
-			header.Name = strings.TrimPrefix(header.Name, "/")
-
-			if compress {
-				header.Method = zip.Deflate
-			} else {
-				header.Method = zip.Store
-			}
-
-			// Open the file for reading
-			entry, _ := writer.CreateHeader(header)
-			fin, err := os.Open(path)
-			if err != nil {
-				writer.Close()
-				file.Close()
-				os.Remove(inputFile)
-				resetUI()
-				accessDenied("Read")
-				return
-			}
+	update()
 
-			// Use a passthrough to catch compression progress
-			passthrough := &compressorProgress{Reader: fin}
-			buf := make([]byte, MiB)
-			_, err = io.CopyBuffer(entry, passthrough, buf)
-			fin.Close()
-
-			if err != nil {
-				insufficientSpace(nil, file)
-				writer.Close()
-				os.Remove(inputFile)
-				return
-			}
+	// Multiple files are zipped straight into the volume
+	archive := mode == "encrypt" && (len(allFiles) > 1 || len(onlyFolders) > 0 || compress)
 
-			if !working {
-				cancel(nil, file)
-				writer.Close()
-				os.Remove(inputFile)
-				return
-			}
+	canCancel = false
+	progress = 0
+	progressInfo = ""
+	update()
+
+	// Rebuild lost chunks from the parity chunks if the user chose to
+	var fin input
+	var total int64
+	var err error
+	var rebuilt []int
+	if recombine && rebuildChunks {
+		popupStatus = "Rebuilding chunks..."
+		update()
+		rebuilt, err = volume.RepairSplit(inputFile, false)
+		if err != nil && err != volume.ErrNotParity {
+			resetUI()
+			mainStatus, exitCode = volumeError(err)
+			mainStatusColor = RED
+			return
 		}
-		writer.Close()
-		file.Close()
 	}
 
-	// Recombine a split file if necessary
+	// Open input file in read-only mode, reading across the chunks if split
 	if recombine {
-		totalFiles := 0
-		totalBytes := int64(0)
-		done := 0
-
-		// Find out the number of splitted chunks
-		for {
-			stat, err := os.Stat(fmt.Sprintf("%s.%d", inputFile, totalFiles))
-			if err != nil {
-				break
-			}
-			totalFiles++
-			totalBytes += stat.Size()
-		}
-
-		// Make sure not to overwrite anything
-		_, err := os.Stat(outputFile + ".pcv")
-		if err == nil { // File already exists
-			mainStatus = "Please remove " + filepath.Base(outputFile+".pcv") + "."
+		var chunks *volume.SplitReader
+		chunks, err = volume.NewSplitReader(inputFile)
+		if err == nil {
+			fin = chunks
+			total = chunks.Size()
+		} else if err == volume.ErrChunkMissing {
+			resetUI()
+			mainStatus, exitCode = volumeError(err)
 			mainStatusColor = RED
 			return
 		}
-
-		// Create a .pcv to combine chunks into
-		fout, err := os.Create(outputFile + ".pcv")
-		if err != nil { // Make sure file is writable
-			accessDenied("Write")
-			return
-		}
-
-		// Merge all chunks into one file
-		startTime := time.Now()
-		for i := 0; i < totalFiles; i++ {
-			fin, err := os.Open(fmt.Sprintf("%s.%d", inputFile, i))
-			if err != nil {
-				fout.Close()
-				os.Remove(outputFile + ".pcv")
-				resetUI()
-				accessDenied("Read")
-				return
-			}
-
-			for {
-				if !working {
-					cancel(fin, fout)
-					os.Remove(outputFile + ".pcv")
-					return
-				}
-
-				// Copy from the chunk into the .pcv
-				data := make([]byte, MiB)
-				read, err := fin.Read(data)
-				if err != nil {
-					break
-				}
-				data = data[:read]
-				_, err = fout.Write(data)
-				done += read
-
-				if err != nil {
-					insufficientSpace(fin, fout)
-					os.Remove(outputFile + ".pcv")
-					return
-				}
-
-				// Update the stats
-				progress, speed, eta = statify(int64(done), totalBytes, startTime)
-				progressInfo = fmt.Sprintf("%d/%d", i+1, totalFiles)
-				popupStatus = fmt.Sprintf("Recombining at %.2f MiB/s (ETA: %s)", speed, eta)
-				giu.Update()
-			}
-			fin.Close()
+	} else if !archive {
+		var file *os.File
+		file, err = os.Open(inputFile)
+		if err == nil {
+			fin = file
+			stat, _ := file.Stat()
+			total = stat.Size()
 		}
-		fout.Close()
-		inputFileOld = inputFile
-		inputFile = outputFile + ".pcv"
-	}
-
-	canCancel = false
-	progress = 0
-	progressInfo = ""
-	giu.Update()
-
-	// Subtract the header size from the total size if decrypting
-	stat, _ := os.Stat(inputFile)
-	total := stat.Size()
-	if mode == "decrypt" {
-		total -= 789
 	}
-
-	// Open input file in read-only mode
-	fin, err := os.Open(inputFile)
 	if err != nil {
 		resetUI()
 		accessDenied("Read")
 		return
 	}
 
-	// Setup output file
-	var fout *os.File
-
-	// If encrypting, generate values and write to file
-	if mode == "encrypt" {
-		popupStatus = "Generating values..."
-		giu.Update()
-
-		// Stores any errors when writing to file
-		errs := make([]error, 11)
-
-		// Make sure not to overwrite anything
-		_, err = os.Stat(outputFile)
-		if split && err == nil { // File already exists
-			fin.Close()
-			mainStatus = "Please remove " + filepath.Base(outputFile) + "."
-			mainStatusColor = RED
-			return
+	// Read values from the header, they are needed if decryption fails
+	var header *volume.Header
+	if mode == "decrypt" {
+		popupStatus = "Reading values..."
+		update()
+		header, _ = volume.ReadHeader(fin)
+		if header != nil {
+			paranoid = header.Paranoid
+			reedsolo = header.ReedSolomon
 		}
+		fin.Seek(0, io.SeekStart)
+	}
 
-		// Create the output file
-		fout, err = os.Create(outputFile)
+	// Hide a file at the end of the padding
+	var hidden *volume.Hidden
+	if mode == "encrypt" && hiddenFile != "" {
+		file, err := os.Open(hiddenFile)
 		if err != nil {
-			fin.Close()
-			accessDenied("Write")
+			if fin != nil {
+				fin.Close()
+			}
+			resetUI()
+			accessDenied("Read")
 			return
 		}
-
-		// Set up cryptographic values
-		salt = make([]byte, 16)
-		hkdfSalt = make([]byte, 32)
-		serpentIV = make([]byte, 16)
-		nonce = make([]byte, 24)
-
-		// Write the program version to file
-		_, errs[0] = fout.Write(rsEncode(rs5, []byte(version)))
-
-		// Encode and write the comment length to file
-		commentsLength := []byte(fmt.Sprintf("%05d", len(comments)))
-		_, errs[1] = fout.Write(rsEncode(rs5, commentsLength))
-
-		// Encode the comment and write to file
-		for _, i := range []byte(comments) {
-			_, err := fout.Write(rsEncode(rs1, []byte{i}))
-			if err != nil {
-				errs[2] = err
-			}
+		defer file.Close()
+		stat, _ := file.Stat()
+		hidden = &volume.Hidden{
+			Key:  volume.Key{Password: hiddenPassword},
+			Data: file,
+			Size: stat.Size(),
 		}
+	}
 
-		// Configure flags and write to file
-		flags := make([]byte, 5)
-		if paranoid { // Paranoid mode selected
-			flags[0] = 1
-		}
-		if len(keyfiles) > 0 { // Keyfiles are being used
-			flags[1] = 1
+	// Store the name, mode, and time of the file so they can be restored
+	var meta *volume.Metadata
+	if archive {
+		name := "Encrypted.zip"
+		if !randomName {
+			name = strings.TrimSuffix(filepath.Base(outputFile), ".pcv")
 		}
-		if keyfileOrdered { // Order of keyfiles matter
-			flags[2] = 1
+		meta = &volume.Metadata{Name: name, Mode: 0644, ModTime: time.Now()}
+	} else if mode == "encrypt" {
+		meta = &volume.Metadata{Name: filepath.Base(inputFile), Mode: 0644, ModTime: time.Now()}
+		if stat, err := os.Stat(inputFile); err == nil {
+			meta.Mode, meta.ModTime = stat.Mode().Perm(), stat.ModTime()
 		}
-		if reedsolo { // Full Reed-Solomon encoding is selected
-			flags[3] = 1
-		}
-		if total%int64(MiB) >= int64(MiB)-128 { // Reed-Solomon internals
-			flags[4] = 1
+	}
+
+	argon2Params, err := selectedArgon2()
+	if err != nil {
+		if fin != nil {
+			fin.Close()
 		}
-		_, errs[3] = fout.Write(rsEncode(rs5, flags))
+		resetUI()
+		mainStatus, exitCode = volumeError(err)
+		mainStatusColor = RED
+		return
+	}
 
-		// Fill values with Go's CSPRNG
-		rand.Read(salt)
-		rand.Read(hkdfSalt)
-		rand.Read(serpentIV)
-		rand.Read(nonce)
+	scheme := padScheme
+	if hideSize && scheme == volume.PadNone {
+		scheme = volume.PadPadme
+	}
 
-		// Encode values with Reed-Solomon and write to file
-		_, errs[4] = fout.Write(rsEncode(rs16, salt))
-		_, errs[5] = fout.Write(rsEncode(rs32, hkdfSalt))
-		_, errs[6] = fout.Write(rsEncode(rs16, serpentIV))
-		_, errs[7] = fout.Write(rsEncode(rs24, nonce))
+	opts := &volume.Options{
+		Password:       password,
+		Keyfiles:       keyfiles,
+		KeyfileOrdered: keyfileOrdered,
+		Comments:       comments,
+		Notes:          notes,
+		Tags:           tags,
+		Paranoid:       paranoid,
+		ReedSolomon:    reedsolo,
+		Parity:         8 << paritySelected,
+		Recipients:     recipients,
+		Keys:           extraKeys,
+		Argon2:         argon2Params,
+		Signer:         signingKey,
+		Detached:       detached,
+		Padding:        padding,
+		PadScheme:      scheme,
+		Hidden:         hidden,
+		Metadata:       meta,
+		Force:          keep,
+		FastDecode:     fastDecode,
+		Identities:     identities,
+	}
 
-		// Write placeholders for future use
-		_, errs[8] = fout.Write(make([]byte, 192))  // Hash of encryption key
-		_, errs[9] = fout.Write(make([]byte, 96))   // Hash of keyfile key
-		_, errs[10] = fout.Write(make([]byte, 192)) // BLAKE2b/HMAC-SHA3 tag
+	// Create the output file, or write straight into chunks if splitting
+	var fout output
+	var splitter *volume.SplitWriter
+	if split {
+		chunkSize, _ := strconv.Atoi(splitSize)
+		limit := 0
 
-		for _, err := range errs {
-			if err != nil {
-				insufficientSpace(fin, fout)
-				os.Remove(outputFile + ".pcv")
-				if len(allFiles) > 1 || len(onlyFolders) > 0 || compress {
-					os.Remove(inputFile)
-				}
-				return
+		// Calculate chunk size
+		if splitSelected == 0 {
+			chunkSize *= KiB
+		} else if splitSelected == 1 {
+			chunkSize *= MiB
+		} else if splitSelected == 2 {
+			chunkSize *= GiB
+		} else if splitSelected == 3 {
+			chunkSize *= TiB
+		} else {
+			// Estimate the size of the volume, the last chunk takes any excess
+			size := total
+			if archive {
+				size = compressTotal
 			}
+			limit = chunkSize
+			size = volume.EncryptedSize(size, opts)
+			chunkSize = int(math.Ceil(float64(size) / float64(limit)))
 		}
-	} else { // Decrypting, read values from file and decode
-		popupStatus = "Reading values..."
-		giu.Update()
-
-		// Stores any Reed-Solomon decoding errors
-		errs := make([]error, 10)
-
-		version := make([]byte, 15)
-		fin.Read(version)
-		_, errs[0] = rsDecode(rs5, version)
-
-		tmp := make([]byte, 15)
-		fin.Read(tmp)
-		tmp, errs[1] = rsDecode(rs5, tmp)
-		commentsLength, _ := strconv.Atoi(string(tmp))
-		fin.Read(make([]byte, commentsLength*3))
-		total -= int64(commentsLength) * 3
-
-		flags := make([]byte, 15)
-		fin.Read(flags)
-		flags, errs[2] = rsDecode(rs5, flags)
-		paranoid = flags[0] == 1
-		reedsolo = flags[3] == 1
-		padded = flags[4] == 1
-
-		salt = make([]byte, 48)
-		fin.Read(salt)
-		salt, errs[3] = rsDecode(rs16, salt)
-
-		hkdfSalt = make([]byte, 96)
-		fin.Read(hkdfSalt)
-		hkdfSalt, errs[4] = rsDecode(rs32, hkdfSalt)
-
-		serpentIV = make([]byte, 48)
-		fin.Read(serpentIV)
-		serpentIV, errs[5] = rsDecode(rs16, serpentIV)
-
-		nonce = make([]byte, 72)
-		fin.Read(nonce)
-		nonce, errs[6] = rsDecode(rs24, nonce)
-
-		keyHashRef = make([]byte, 192)
-		fin.Read(keyHashRef)
-		keyHashRef, errs[7] = rsDecode(rs64, keyHashRef)
-
-		keyfileHashRef = make([]byte, 96)
-		fin.Read(keyfileHashRef)
-		keyfileHashRef, errs[8] = rsDecode(rs32, keyfileHashRef)
-
-		authTag = make([]byte, 192)
-		fin.Read(authTag)
-		authTag, errs[9] = rsDecode(rs64, authTag)
-
-		// If there was an issue during decoding, the header is corrupted
-		for _, err := range errs {
-			if err != nil {
-				if keep { // If the user chooses to force decrypt
-					kept = true
-				} else {
-					broken(fin, nil, "The volume header is damaged.")
-					return
-				}
-			}
+		splitter, err = volume.NewSplitWriter(outputFile, int64(chunkSize), limit)
+		fout = splitter
+	} else {
+		fout, err = os.Create(outputFile)
+	}
+	if err != nil {
+		if fin != nil {
+			fin.Close()
 		}
+		accessDenied("Write")
+		return
 	}
 
 	popupStatus = "Deriving key..."
-	giu.Update()
-
-	// Derive encryption keys and subkeys
-	var key []byte
-	if paranoid {
-		key = argon2.IDKey(
-			[]byte(password),
-			salt,
-			8,     // 8 passes
-			1<<20, // 1 GiB memory
-			8,     // 8 threads
-			32,    // 32-byte output key
-		)
-	} else {
-		key = argon2.IDKey(
-			[]byte(password),
-			salt,
-			4,
-			1<<20,
-			4,
-			32,
-		)
-	}
-
-	// If keyfiles are being used
-	if len(keyfiles) > 0 || keyfile {
-		popupStatus = "Reading keyfiles..."
-		giu.Update()
-
-		if keyfileOrdered { // If order matters, hash progressively
-			var tmp = sha3.New256()
-
-			// For each keyfile...
-			for _, path := range keyfiles {
-				fin, _ := os.Open(path)
-				stat, _ := os.Stat(path)
-				data := make([]byte, stat.Size())
-				fin.Read(data) // Read the keyfile
-				fin.Close()
-				tmp.Write(data) // Hash the data
-			}
-			keyfileKey = tmp.Sum(nil) // Get the SHA3-256
-
-			// Store a hash of 'keyfileKey' for comparison
-			tmp = sha3.New256()
-			tmp.Write(keyfileKey)
-			keyfileHash = tmp.Sum(nil)
-		} else { // If order doesn't matter, hash individually and combine
-			for _, path := range keyfiles {
-				fin, _ := os.Open(path)
-				stat, _ := os.Stat(path)
-				data := make([]byte, stat.Size())
-				fin.Read(data) // Read the keyfile
-				fin.Close()
+	update()
 
-				// Get the SHA3-256
-				tmp := sha3.New256()
-				tmp.Write(data)
-				sum := tmp.Sum(nil)
+	// Report progress and catch cancelling while the volume library works
+	passthrough := &workProgress{Reader: fin, total: total, start: time.Now()}
+	if header != nil {
+		passthrough.header = header.Size()
+	}
 
-				// XOR keyfile hash with 'keyfileKey'
-				if keyfileKey == nil {
-					keyfileKey = sum
-				} else {
-					for i, j := range sum {
-						keyfileKey[i] ^= j
-					}
-				}
+	// Start the main encryption process
+	var revealed string
+	canCancel = true
+	if mode == "encrypt" {
+		var writer *volume.Writer
+		writer, err = volume.NewWriter(fout, opts)
+		if err == nil {
+			if archive {
+				err = zipFiles(writer)
+			} else {
+				_, err = io.CopyBuffer(writer, passthrough, make([]byte, MiB))
 			}
-
-			// Store a hash of 'keyfileKey' for comparison
-			tmp := sha3.New256()
-			tmp.Write(keyfileKey)
-			keyfileHash = tmp.Sum(nil)
 		}
-	}
-
-	popupStatus = "Calculating values..."
-	giu.Update()
+		if err == nil && working {
+			err = writer.Close()
+		}
 
-	// Hash the encryption key for comparison when decrypting
-	tmp := sha3.New512()
-	tmp.Write(key)
-	keyHash = tmp.Sum(nil)
+		// Save a detached signature next to the volume
+		if err == nil && working && detached {
+			err = os.WriteFile(outputFile+".sig", writer.Signature(), 0644)
+		}
 
-	// Validate the password and/or keyfiles
-	if mode == "decrypt" {
-		keyCorrect := subtle.ConstantTimeCompare(keyHash, keyHashRef) == 1
-		keyfileCorrect := subtle.ConstantTimeCompare(keyfileHash, keyfileHashRef) == 1
-		incorrect := !keyCorrect
-		if keyfile {
-			incorrect = !keyCorrect || !keyfileCorrect
+		// A parity file covers the whole volume, so it's made once it's finished
+		if err == nil && working && recovery && splitter == nil {
+			popupStatus = "Writing recovery file..."
+			update()
+			err = writeRecovery(outputFile, outputFile+".parity", recoveryPercent)
 		}
 
-		// If something is incorrect
-		if incorrect {
-			if keep {
-				kept = true
+		// Parity chunks are made from the chunks once they are all written
+		if err == nil && working && recovery && splitter != nil {
+			popupStatus = "Writing parity chunks..."
+			update()
+			splitter.Close()
+			count := recoveryChunks
+			if count == 0 {
+				count = (len(splitter.Chunks())*recoveryPercent + 99) / 100
+			}
+			if len(splitter.Chunks())+count > 256 {
+				err = volume.ErrTooManyChunks
 			} else {
-				if !keyCorrect {
-					mainStatus = "The provided password is incorrect."
-				} else {
-					if keyfileOrdered {
-						mainStatus = "Incorrect keyfiles or ordering."
-					} else {
-						mainStatus = "Incorrect keyfiles."
-					}
-				}
-				broken(fin, nil, mainStatus)
-				return
+				err = volume.WriteSplitParity(outputFile, count)
 			}
 		}
-
-		// Create the output file for decryption
-		fout, err = os.Create(outputFile)
-		if err != nil {
-			fin.Close()
-			accessDenied("Write")
-			return
+	} else {
+		var reader *volume.Reader
+		reader, err = volume.NewReader(passthrough, opts)
+		if err == nil {
+			meta = reader.Metadata()
+			revealed = reader.Notes()
+			_, err = io.CopyBuffer(fout, reader, make([]byte, MiB))
 		}
 	}
 
-	if len(keyfiles) > 0 || keyfile {
-		// XOR the encryption key with the keyfile key
-		tmp := key
-		key = make([]byte, 32)
-		for i := range key {
-			key[i] = tmp[i] ^ keyfileKey[i]
+	if !working {
+		cancel(fin, fout)
+		if splitter != nil { // Remove unfinished chunks
+			splitter.Remove()
+		} else {
+			os.Remove(outputFile)
 		}
+		return
 	}
 
-	done, counter := 0, 0
-	chacha, _ := chacha20.NewUnauthenticatedCipher(key, nonce)
-
-	// Use HKDF-SHA3 to generate a subkey for the MAC
-	var mac hash.Hash
-	subkey := make([]byte, 32)
-	hkdf := hkdf.New(sha3.New256, key, hkdfSalt, nil)
-	hkdf.Read(subkey)
-	if paranoid {
-		mac = hmac.New(sha3.New512, subkey) // HMAC-SHA3
-	} else {
-		mac, _ = blake2b.New512(subkey) // Keyed BLAKE2b
-	}
-
-	// Generate another subkey for use as Serpent's key
-	serpentKey := make([]byte, 32)
-	hkdf.Read(serpentKey)
-	s, _ := serpent.NewCipher(serpentKey)
-	serpent := cipher.NewCTR(s, serpentIV)
-
-	// Start the main encryption process
-	canCancel = true
-	startTime := time.Now()
-	for {
-		if !working {
-			cancel(fin, fout)
-			if recombine || len(allFiles) > 1 || len(onlyFolders) > 0 || compress {
-				os.Remove(inputFile)
-			}
-			os.Remove(outputFile)
+	switch err {
+	case nil:
+	case volume.ErrModified:
+		// Decrypt again but this time rebuilding the input data
+		if reedsolo && fastDecode {
+			fastDecode = false
+			fin.Close()
+			fout.Close()
+			work()
 			return
 		}
 
-		// Read in data from the file
-		var src []byte
-		if mode == "decrypt" && reedsolo {
-			src = make([]byte, MiB/128*136)
+		if keep {
+			kept = true
 		} else {
-			src = make([]byte, MiB)
-		}
-		size, err := fin.Read(src)
-		if err != nil {
-			break
-		}
-		src = src[:size]
-		dst := make([]byte, len(src))
-
-		// Do the actual encryption
-		if mode == "encrypt" {
-			if paranoid {
-				serpent.XORKeyStream(dst, src)
-				copy(src, dst)
-			}
-
-			chacha.XORKeyStream(dst, src)
-			mac.Write(dst)
-
-			if reedsolo {
-				copy(src, dst)
-				dst = nil
-				// If a full MiB is available
-				if len(src) == MiB {
-					// Encode every chunk
-					for i := 0; i < MiB; i += 128 {
-						dst = append(dst, rsEncode(rs128, src[i:i+128])...)
-					}
-				} else {
-					// Encode the full chunks
-					chunks := math.Floor(float64(len(src)) / 128)
-					for i := 0; float64(i) < chunks; i++ {
-						dst = append(dst, rsEncode(rs128, src[i*128:(i+1)*128])...)
-					}
-
-					// Pad and encode the final partial chunk
-					dst = append(dst, rsEncode(rs128, pad(src[int(chunks*128):]))...)
-				}
-			}
-		} else { // Decryption
-			if reedsolo {
-				copy(dst, src)
-				src = nil
-				// If a complete 1 MiB block is available
-				if len(dst) == MiB/128*136 {
-					// Decode every chunk
-					for i := 0; i < MiB/128*136; i += 136 {
-						tmp, err := rsDecode(rs128, dst[i:i+136])
-						if err != nil {
-							if keep {
-								kept = true
-							} else {
-								broken(fin, fout, "The input file is irrecoverably damaged.")
-								return
-							}
-						}
-						if i == MiB/128*136-136 && done+MiB/128*136 >= int(total) && padded {
-							tmp = unpad(tmp)
-						}
-						src = append(src, tmp...)
-
-						if !fastDecode && i%17408 == 0 {
-							progress, speed, eta = statify(int64(done+i), total, startTime)
-							progressInfo = fmt.Sprintf("%.2f%%", progress*100)
-							popupStatus = fmt.Sprintf("Repairing at %.2f MiB/s (ETA: %s)", speed, eta)
-							giu.Update()
-						}
-					}
-				} else {
-					// Decode the full chunks
-					chunks := len(dst)/136 - 1
-					for i := 0; i < chunks; i++ {
-						tmp, err := rsDecode(rs128, dst[i*136:(i+1)*136])
-						if err != nil {
-							if keep {
-								kept = true
-							} else {
-								broken(fin, fout, "The input file is irrecoverably damaged.")
-								return
-							}
-						}
-						src = append(src, tmp...)
-
-						if !fastDecode && i%128 == 0 {
-							progress, speed, eta = statify(int64(done+i*136), total, startTime)
-							progressInfo = fmt.Sprintf("%.2f%%", progress*100)
-							popupStatus = fmt.Sprintf("Repairing at %.2f MiB/s (ETA: %s)", speed, eta)
-							giu.Update()
-						}
-					}
-
-					// Unpad and decode the final partial chunk
-					tmp, err := rsDecode(rs128, dst[int(chunks)*136:])
-					if err != nil {
-						if keep {
-							kept = true
-						} else {
-							broken(fin, fout, "The input file is irrecoverably damaged.")
-							return
-						}
-					}
-					src = append(src, unpad(tmp)...)
-				}
-				dst = make([]byte, len(src))
-			}
-
-			mac.Write(src)
-			chacha.XORKeyStream(dst, src)
-
-			if paranoid {
-				copy(src, dst)
-				serpent.XORKeyStream(dst, src)
-			}
-		}
-
-		// Write the data to output file
-		_, err = fout.Write(dst)
-		if err != nil {
-			insufficientSpace(fin, fout)
-			if recombine || len(allFiles) > 1 || len(onlyFolders) > 0 || compress {
-				os.Remove(inputFile)
-			}
-			os.Remove(outputFile)
+			broken(fin, fout, exitDamaged, "The input file is damaged or modified.")
 			return
 		}
-
-		// Update stats
-		if mode == "decrypt" && reedsolo {
-			done += MiB / 128 * 136
-		} else {
-			done += MiB
-		}
-		counter += MiB
-		progress, speed, eta = statify(int64(done), total, startTime)
-		progressInfo = fmt.Sprintf("%.2f%%", progress*100)
-		if mode == "encrypt" {
-			popupStatus = fmt.Sprintf("Encrypting at %.2f MiB/s (ETA: %s)", speed, eta)
-		} else {
-			if fastDecode {
-				popupStatus = fmt.Sprintf("Decrypting at %.2f MiB/s (ETA: %s)", speed, eta)
+	default:
+		// A file to be zipped couldn't be read
+		if archive && (os.IsPermission(err) || os.IsNotExist(err)) {
+			fout.Close()
+			if splitter != nil {
+				splitter.Remove()
+			} else {
+				os.Remove(outputFile)
 			}
+			resetUI()
+			accessDenied("Read")
+			return
 		}
-		giu.Update()
 
-		// Change nonce/IV after 60 GiB to prevent overflow
-		if counter >= 60*GiB {
-			// ChaCha20
-			nonce = make([]byte, 24)
-			hkdf.Read(nonce)
-			chacha, _ = chacha20.NewUnauthenticatedCipher(key, nonce)
-
-			// Serpent
-			serpentIV = make([]byte, 16)
-			hkdf.Read(serpentIV)
-			serpent = cipher.NewCTR(s, serpentIV)
-
-			// Reset counter to 0
-			counter = 0
+		// Any other error has its own message, a full disk included
+		message, code := volumeError(err)
+		broken(fin, fout, code, message)
+		if splitter != nil { // Remove unfinished chunks
+			splitter.Remove()
 		}
+		return
 	}
 
-	progress = 0
-	progressInfo = ""
-	giu.Update()
-
-	if mode == "encrypt" {
-		popupStatus = "Writing values..."
-		giu.Update()
-
-		// Seek back to header and write important values
-		fout.Seek(int64(309+len(comments)*3), 0)
-		fout.Write(rsEncode(rs64, keyHash))
-		fout.Write(rsEncode(rs32, keyfileHash))
-		fout.Write(rsEncode(rs64, mac.Sum(nil)))
-	} else {
-		popupStatus = "Comparing values..."
-		giu.Update()
-
-		// Validate the authenticity of decrypted data
-		if subtle.ConstantTimeCompare(mac.Sum(nil), authTag) == 0 {
-			// Decrypt again but this time rebuilding the input data
-			if reedsolo && fastDecode {
-				fastDecode = false
-				fin.Close()
-				fout.Close()
-				work()
-				return
-			}
-
-			if keep {
-				kept = true
-			} else {
-				broken(fin, fout, "The input file is damaged or modified.")
-				return
-			}
-		}
+	if fin != nil {
+		fin.Close()
 	}
-
-	fin.Close()
 	fout.Close()
 
-	// Split the file into chunks
-	if split {
-		var splitted []string
-		stat, _ := os.Stat(outputFile)
-		size := stat.Size()
-		finishedFiles := 0
-		finishedBytes := 0
-		chunkSize, _ := strconv.Atoi(splitSize)
-
-		// Calculate chunk size
-		if splitSelected == 0 {
-			chunkSize *= KiB
-		} else if splitSelected == 1 {
-			chunkSize *= MiB
-		} else if splitSelected == 2 {
-			chunkSize *= GiB
-		} else if splitSelected == 3 {
-			chunkSize *= TiB
-		} else {
-			chunkSize = int(math.Ceil(float64(size) / float64(chunkSize)))
-		}
-
-		// Get the number of required chunks
-		chunks := int(math.Ceil(float64(size) / float64(chunkSize)))
-		progressInfo = fmt.Sprintf("%d/%d", finishedFiles+1, chunks)
-		giu.Update()
-
-		// Open the volume for reading
-		fin, _ := os.Open(outputFile)
-
-		// Start the splitting process
-		startTime := time.Now()
-		for i := 0; i < chunks; i++ {
-			// Make the chunk
-			fout, _ := os.Create(fmt.Sprintf("%s.%d", outputFile, i))
-			done := 0
-
-			// Copy data into the chunk
-			for {
-				data := make([]byte, MiB)
-				for done+len(data) > chunkSize {
-					data = make([]byte, int(math.Ceil(float64(len(data))/2)))
-				}
-
-				read, err := fin.Read(data)
-				if err != nil {
-					break
-				}
-				if !working {
-					cancel(fin, fout)
-					if len(allFiles) > 1 || len(onlyFolders) > 0 || compress {
-						os.Remove(inputFile)
-					}
-					os.Remove(outputFile)
-					for _, j := range splitted { // Remove unfinished chunks
-						os.Remove(j)
-					}
-					os.Remove(fmt.Sprintf("%s.%d", outputFile, i))
-					return
-				}
-
-				data = data[:read]
-				_, err = fout.Write(data)
-				if err != nil {
-					insufficientSpace(fin, fout)
-					if len(allFiles) > 1 || len(onlyFolders) > 0 || compress {
-						os.Remove(inputFile)
-					}
-					os.Remove(outputFile)
-					for _, j := range splitted { // Remove unfinished chunks
-						os.Remove(j)
-					}
-					os.Remove(fmt.Sprintf("%s.%d", outputFile, i))
-					return
-				}
-				done += read
-				if done >= chunkSize {
-					break
-				}
-
-				// Update stats
-				finishedBytes += read
-				progress, speed, eta = statify(int64(finishedBytes), int64(size), startTime)
-				popupStatus = fmt.Sprintf("Splitting at %.2f MiB/s (ETA: %s)", speed, eta)
-				giu.Update()
-			}
-			fout.Close()
-
-			// Update stats
-			finishedFiles++
-			if finishedFiles == chunks {
-				finishedFiles--
-			}
-			splitted = append(splitted, fmt.Sprintf("%s.%d", outputFile, i))
-			progressInfo = fmt.Sprintf("%d/%d", finishedFiles+1, chunks)
-			giu.Update()
-		}
-
-		fin.Close()
-		os.Remove(outputFile)
+	// Give the decrypted file back its name, mode, and time
+	if mode == "decrypt" && meta != nil {
+		restoreMetadata(meta)
 	}
 
 	canCancel = false
 	progress = 0
 	progressInfo = ""
-	giu.Update()
-
-	// Remove the temporary file used to combine a splitted volume
-	if recombine {
-		os.Remove(inputFile)
-	}
-
-	// Delete the temporary .zip used to encrypt multiple files
-	if len(allFiles) > 1 || len(onlyFolders) > 0 || compress {
-		os.Remove(inputFile)
+	update()
+
+	// Write the corrections back to a volume that needed them
+	repaired := false
+	if mode == "decrypt" && repair && !fastDecode && !recombine && !delete {
+		popupStatus = "Repairing volume..."
+		update()
+		if f, err := os.OpenFile(inputFile, os.O_RDWR, 0); err == nil {
+			_, err = volume.Repair(f)
+			f.Close()
+			repaired = err == nil
+		}
 	}
 
 	// Delete the input files if the user chooses
 	if delete {
 		popupStatus = "Deleting files..."
-		giu.Update()
+		update()
 
 		if mode == "decrypt" {
 			if recombine { // Remove each chunk of volume
 				i := 0
 				for {
-					_, err := os.Stat(fmt.Sprintf("%s.%d", inputFileOld, i))
+					_, err := os.Stat(fmt.Sprintf("%s.%d", inputFile, i))
 					if err != nil {
 						break
 					}
-					os.Remove(fmt.Sprintf("%s.%d", inputFileOld, i))
+					os.Remove(fmt.Sprintf("%s.%d", inputFile, i))
 					i++
 				}
+				for i := 0; i < 256; i++ {
+					os.Remove(fmt.Sprintf("%s.p%d", inputFile, i))
+				}
 			} else {
 				os.Remove(inputFile)
 			}
@@ -1798,60 +1436,271 @@ func work() {
 	resetUI()
 	kept = oldKept
 
+	// Show the encrypted notes now that they have been decrypted
+	revealedNotes = revealed
+	if revealed != "" && window != nil {
+		showNotes = true
+		modalId++
+	}
+
 	// If the user chose to keep a corrupted/modified file, let them know
 	if kept {
 		mainStatus = "The input file was modified. Please be careful."
 		mainStatusColor = YELLOW
+		exitCode = exitModified
+	} else if repaired {
+		mainStatus = "Completed. The volume was repaired."
+		mainStatusColor = GREEN
+	} else if len(rebuilt) > 0 {
+		mainStatus = fmt.Sprintf("Completed. Rebuilt %d lost chunk(s) from the parity chunks.", len(rebuilt))
+		mainStatusColor = GREEN
 	} else {
 		mainStatus = "Completed."
 		mainStatusColor = GREEN
 	}
 }
 
+// Apply the metadata of the original file to the output, renaming it unless
+// a name was chosen. Stored names are only used as a base name, and nothing
+// existing is replaced.
+func restoreMetadata(meta *volume.Metadata) {
+	if meta.Mode != 0 {
+		os.Chmod(outputFile, meta.Mode)
+	}
+	if !meta.ModTime.IsZero() {
+		os.Chtimes(outputFile, meta.ModTime, meta.ModTime)
+	}
+	if outputCustom {
+		return
+	}
+	name := filepath.Base(filepath.FromSlash(meta.Name))
+	if name == "." || name == ".." || name == string(filepath.Separator) {
+		return
+	}
+	path := filepath.Join(filepath.Dir(outputFile), name)
+	if _, err := os.Lstat(path); err == nil {
+		return
+	}
+	if os.Rename(outputFile, path) == nil {
+		outputFile = path
+	}
+}
+
+// Save a parity file for a volume that can rebuild damaged parts of it
+func writeRecovery(path string, output string, redundancy int) error {
+	fin, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fin.Close()
+	fout, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	err = volume.WriteParity(fout, fin, redundancy)
+	if err == nil {
+		err = fout.Close()
+	} else {
+		fout.Close()
+	}
+	if err != nil {
+		os.Remove(output)
+	}
+	return err
+}
+
+// Report whether any chunks of a split volume already exist. The directory
+// is listed rather than globbed, since the name could contain a * or [
+func chunksExist(name string) bool {
+	entries, _ := os.ReadDir(filepath.Dir(name))
+	for _, i := range entries {
+		if strings.HasPrefix(i.Name(), filepath.Base(name)+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// A random name for a volume, so it doesn't give away what it holds
+func randomOutput(path string) string {
+	name := make([]byte, 16)
+	rand.Read(name)
+	return filepath.Join(filepath.Dir(path), hex.EncodeToString(name)) + ".pcv"
+}
+
+// Add the selected files to a .zip that is written into w
+func zipFiles(w io.Writer) error {
+	// Consider case where compressing only one file
+	files := allFiles
+	if len(allFiles) == 0 {
+		files = onlyFiles
+	}
+
+	// Get the root directory of the selected files
+	var rootDir string
+	if len(onlyFolders) > 0 {
+		rootDir = filepath.Dir(onlyFolders[0])
+	} else {
+		rootDir = filepath.Dir(onlyFiles[0])
+	}
+
+	// Add each file to the .zip
+	writer := zip.NewWriter(w)
+	compressStart = time.Now()
+	for i, path := range files {
+		progressInfo = fmt.Sprintf("%d/%d", i+1, len(files))
+		update()
+
+		// Create file info header (size, last modified, etc.)
+		stat, err := os.Stat(path)
+		if err != nil {
+			continue // Skip temporary and inaccessible files
+		}
+		header, _ := zip.FileInfoHeader(stat)
+		header.Name = strings.TrimPrefix(path, rootDir)
+		header.Name = filepath.ToSlash(header.Name)
+		header.Name = strings.TrimPrefix(header.Name, "/")
+
+		if compress {
+			header.Method = zip.Deflate
+		} else {
+			header.Method = zip.Store
+		}
+
+		// Open the file for reading
+		fin, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		entry, err := writer.CreateHeader(header)
+		if err != nil {
+			fin.Close()
+			return err
+		}
+
+		// Use a passthrough to catch compression progress
+		passthrough := &compressorProgress{Reader: fin}
+		buf := make([]byte, MiB)
+		_, err = io.CopyBuffer(entry, passthrough, buf)
+		fin.Close()
+
+		if err != nil {
+			return err
+		}
+		if !working {
+			return nil
+		}
+	}
+	return writer.Close()
+}
+
 // If the OS denies reading or writing to a file
 func accessDenied(s string) {
 	mainStatus = s + " access denied by operating system."
 	mainStatusColor = RED
-}
-
-// If there isn't enough disk space
-func insufficientSpace(fin *os.File, fout *os.File) {
-	fin.Close()
-	fout.Close()
-	mainStatus = "Insufficient disk space."
-	mainStatusColor = RED
+	exitCode = exitAccess
 }
 
 // If corruption is detected during decryption
-func broken(fin *os.File, fout *os.File, message string) {
-	fin.Close()
+func broken(fin io.Closer, fout io.Closer, code int, message string) {
+	if fin != nil {
+		fin.Close()
+	}
 	fout.Close()
 	mainStatus = message
 	mainStatusColor = RED
+	exitCode = code
 
 	// Clean up files since decryption failed
-	if recombine {
-		os.Remove(inputFile)
-	}
 	os.Remove(outputFile)
 }
 
+// Get the status message and exit code for an error from the volume package or the OS
+func volumeError(err error) (string, int) {
+	switch err {
+	case volume.ErrNotVolume, volume.ErrHeaderDamaged:
+		return "The volume header is damaged.", exitDamaged
+	case volume.ErrHeaderModified:
+		return "The volume header has been tampered with.", exitDamaged
+	case volume.ErrKeyfilesRequired:
+		return "Please select your keyfiles.", exitIncorrect
+	case volume.ErrIncorrectPassword:
+		return "The provided password is incorrect.", exitIncorrect
+	case volume.ErrIncorrectKeyfiles:
+		if keyfileOrdered {
+			return "Incorrect keyfiles or ordering.", exitIncorrect
+		}
+		return "Incorrect keyfiles.", exitIncorrect
+	case volume.ErrIncorrectIdentity:
+		return "None of the identities can decrypt this volume.", exitIncorrect
+	case volume.ErrDamaged:
+		return "The input file is irrecoverably damaged.", exitDamaged
+	case volume.ErrModified:
+		return "The input file is damaged or modified.", exitDamaged
+	case volume.ErrOldVersion:
+		return "Volumes from before v2 can't be rekeyed or signed.", exitFailure
+	case volume.ErrNoRoom:
+		return "There isn't enough room in the volume for more keys.", exitFailure
+	case volume.ErrPadded:
+		return "The Argon2 parameters of a volume with padding can't be changed.", exitUsage
+	case volume.ErrCommentsTooLong:
+		return "The comments are too long.", exitUsage
+	case volume.ErrInvalidTag:
+		return "Tags need a key of 1 to 255 bytes and UTF-8 text.", exitUsage
+	case volume.ErrInvalidArgon2:
+		return "Invalid Argon2 parameters.", exitUsage
+	case volume.ErrTooManyPasswords:
+		return fmt.Sprintf("A volume can have at most %d passwords.", volume.MaxPasswordSlots), exitUsage
+	case volume.ErrInvalidParity:
+		return "The Reed-Solomon parity must be 8, 16, 32, or 64 bytes.", exitUsage
+	case volume.ErrHeaderFull:
+		return "The notes and tags don't fit in the header.", exitUsage
+	case volume.ErrInvalidPadding:
+		return "Invalid padding.", exitUsage
+	case volume.ErrHiddenTooLarge:
+		return "The padding is too small for the hidden file.", exitUsage
+	case volume.ErrInvalidRedundancy:
+		return "The redundancy must be 1 to 100 percent.", exitUsage
+	case volume.ErrNotParity:
+		return "The parity file is damaged or isn't a parity file.", exitDamaged
+	case volume.ErrStaleParity:
+		return "The volume was rekeyed or signed after the parity was made, so it can't be used.", exitFailure
+	case volume.ErrChunkMissing:
+		return "A chunk of the split volume is missing.", exitDamaged
+	case volume.ErrTooManyChunks:
+		return "There can be at most 256 chunks, including the parity chunks.", exitUsage
+	case volume.ErrNotSigned:
+		return "The volume isn't signed.", exitFailure
+	case volume.ErrBadSignature:
+		return "The signature doesn't match the volume or the public key.", exitDamaged
+	}
+	if errors.Is(err, syscall.ENOSPC) {
+		return "Insufficient disk space.", exitSpace
+	}
+	return "Unexpected error: " + err.Error() + ".", exitFailure
+}
+
 // Stop working if user hits "Cancel"
-func cancel(fin *os.File, fout *os.File) {
-	fin.Close()
+func cancel(fin io.Closer, fout io.Closer) {
+	if fin != nil {
+		fin.Close()
+	}
 	fout.Close()
 	mainStatus = "Operation cancelled by user."
 	mainStatusColor = WHITE
+	exitCode = exitCancelled
 }
 
 // Reset the UI to a clean state with nothing selected or checked
 func resetUI() {
-	imgui.ClearActiveID()
+	if window != nil {
+		imgui.ClearActiveID()
+	}
 	mode = ""
 
 	inputFile = ""
-	inputFileOld = ""
 	outputFile = ""
+	outputCustom = false
 	onlyFiles = nil
 	onlyFolders = nil
 	allFiles = nil
@@ -1877,74 +1726,42 @@ func resetUI() {
 	comments = ""
 	commentsLabel = "Comments:"
 	commentsDisabled = false
+	notes = ""
 
 	paranoid = false
 	reedsolo = false
+	paritySelected = 0
 	split = false
 	splitSize = ""
 	splitSelected = 1
+	argon2Selected = 0
+	hideSize = false
+	randomName = false
+	recovery = false
 	recombine = false
 	compress = false
 	delete = false
 	keep = false
+	repair = false
+	rebuildChunks = false
 	kept = false
 
 	startLabel = "Start"
 	mainStatus = "Ready."
 	mainStatusColor = WHITE
+	exitCode = exitSuccess
 	popupStatus = ""
 
 	progress = 0
 	progressInfo = ""
-	giu.Update()
-}
-
-// Reed-Solomon encoder
-func rsEncode(rs *infectious.FEC, data []byte) []byte {
-	res := make([]byte, rs.Total())
-	rs.Encode(data, func(s infectious.Share) {
-		res[s.Number] = s.Data[0]
-	})
-	return res
+	update()
 }
 
-// Reed-Solomon decoder
-func rsDecode(rs *infectious.FEC, data []byte) ([]byte, error) {
-	// If fast decode, just return the first 128 bytes
-	if rs.Total() == 136 && fastDecode {
-		return data[:128], nil
-	}
-
-	tmp := make([]infectious.Share, rs.Total())
-	for i := 0; i < rs.Total(); i++ {
-		tmp[i].Number = i
-		tmp[i].Data = append(tmp[i].Data, data[i])
-	}
-	res, err := rs.Decode(nil, tmp)
-
-	// Force decode the data but return the error as well
-	if err != nil {
-		if rs.Total() == 136 {
-			return data[:128], err
-		}
-		return data[:rs.Total()/3], err
+// Redraw the UI if there is a window (there isn't one when running headless)
+func update() {
+	if window != nil {
+		giu.Update()
 	}
-
-	// No issues, return the decoded data
-	return res, nil
-}
-
-// PKCS#7 pad (for use with Reed-Solomon)
-func pad(data []byte) []byte {
-	padLen := 128 - len(data)%128
-	padding := bytes.Repeat([]byte{byte(padLen)}, padLen)
-	return append(data, padding...)
-}
-
-// PKCS#7 unpad
-func unpad(data []byte) []byte {
-	padLen := int(data[127])
-	return data[:128-padLen]
 }
 
 // Generate a cryptographically secure password
@@ -1973,6 +1790,25 @@ func genPassword() string {
 	return string(tmp)
 }
 
+// Get the Argon2 parameters chosen in the window or on the command line
+func selectedArgon2() (*volume.Argon2, error) {
+	var a volume.Argon2
+	switch {
+	case argon2Custom != nil:
+		a = *argon2Custom
+	case argon2Selected == 1:
+		a = volume.Argon2Low
+	case argon2Selected == 2:
+		a = volume.Argon2Strong
+	default:
+		return nil, nil // Let the volume package pick based on paranoid mode
+	}
+	if !a.Valid() {
+		return nil, volume.ErrInvalidArgon2
+	}
+	return &a, nil
+}
+
 // Convert done, total, and starting time to progress, speed, and ETA
 func statify(done int64, total int64, start time.Time) (float32, float64, string) {
 	progress := float32(done) / float32(total)
@@ -2007,12 +1843,1593 @@ func sizeify(size int64) string {
 	}
 }
 
-func main() {
-	// Set DPI awareness to system aware (value of 1)
-	if runtime.GOOS == "windows" {
-		shcore := syscall.NewLazyDLL("Shcore.dll")
-		shproc := shcore.NewProc("SetProcessDpiAwareness")
-		shproc.Call(uintptr(1))
+// Repeatable command-line flag (used for keyfiles)
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ", ")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// Key derivation flags shared by encrypt and rekey
+type argon2Flags struct {
+	preset    *string
+	time      *uint
+	memory    *uint
+	threads   *uint
+	calibrate *float64
+}
+
+func addArgon2Flags(flags *flag.FlagSet) *argon2Flags {
+	return &argon2Flags{
+		preset:    flags.String("argon2", "", "Argon2 `preset`: normal, paranoid, low, or strong"),
+		time:      flags.Uint("argon2-time", 0, "use `n` Argon2 passes"),
+		memory:    flags.Uint("argon2-memory", 0, "use `MiB` of memory for Argon2"),
+		threads:   flags.Uint("argon2-threads", 0, "use `n` threads for Argon2"),
+		calibrate: flags.Float64("calibrate", 0, "pick the Argon2 passes so deriving a key takes `seconds`"),
+	}
+}
+
+// Get the parameters given by the flags, or nil for the defaults of the mode
+func (f *argon2Flags) params(paranoid bool) (*volume.Argon2, error) {
+	if *f.preset == "" && *f.time == 0 && *f.memory == 0 && *f.threads == 0 && *f.calibrate == 0 {
+		return nil, nil
+	}
+	a := volume.Argon2Normal
+	switch strings.ToLower(*f.preset) {
+	case "":
+		if paranoid {
+			a = volume.Argon2Paranoid
+		}
+	case "normal":
+	case "paranoid":
+		a = volume.Argon2Paranoid
+	case "low":
+		a = volume.Argon2Low
+	case "strong":
+		a = volume.Argon2Strong
+	default:
+		return nil, fmt.Errorf("Unknown Argon2 preset %s.", *f.preset)
+	}
+
+	if *f.time > 0 {
+		if *f.calibrate > 0 {
+			return nil, fmt.Errorf("Use either -argon2-time or -calibrate.")
+		}
+		a.Time = uint32(*f.time)
+	}
+	if *f.time > volume.MaxArgon2Time {
+		return nil, fmt.Errorf("Argon2 can use at most %d passes.", volume.MaxArgon2Time)
+	}
+	if *f.memory > 0 {
+		if *f.memory > uint(volume.MaxArgon2Memory/KiB) {
+			return nil, fmt.Errorf("Argon2 can use at most %d MiB of memory.", volume.MaxArgon2Memory/KiB)
+		}
+		a.Memory = uint32(*f.memory * uint(KiB))
+	}
+	if *f.threads > 0 {
+		if *f.threads > 255 {
+			return nil, fmt.Errorf("Argon2 can use at most 255 threads.")
+		}
+		a.Threads = uint8(*f.threads)
+	}
+	if *f.calibrate < 0 {
+		return nil, fmt.Errorf("Invalid calibration time.")
+	}
+	if *f.calibrate > 0 {
+		fmt.Fprintln(os.Stderr, "Calibrating Argon2...")
+		a = volume.CalibrateArgon2(a.Memory, a.Threads, time.Duration(*f.calibrate*float64(time.Second)))
+		fmt.Fprintf(os.Stderr, "Using %d passes, %d MiB of memory, and %d threads.\n", a.Time, a.Memory/uint32(KiB), a.Threads)
+	}
+	if a.Memory < 8*uint32(a.Threads) {
+		return nil, fmt.Errorf("Argon2 needs at least 8 KiB of memory for each thread.")
+	}
+	if !a.Valid() {
+		return nil, fmt.Errorf("Argon2 can use at most %d passes of 1 GiB of memory, or fewer passes of more.", volume.MaxArgon2Work/(GiB/KiB))
+	}
+	return &a, nil
+}
+
+// Run a command without a window, driving the same work() as the GUI
+func cli(args []string) int {
+	command := args[0]
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	flags.Usage = func() {
+		if command == "encrypt" {
+			fmt.Fprintln(os.Stderr, "Usage: picocrypt encrypt [options] <files and folders... | ->")
+		} else {
+			fmt.Fprintln(os.Stderr, "Usage: picocrypt decrypt [options] <volume | ->")
+		}
+		flags.PrintDefaults()
+	}
+
+	// Options shared by encryption and decryption
+	var cliKeyfiles stringList
+	cliOutput := flags.String("o", "", "save the output as `path` (\"-\" for stdout when decrypting stdin)")
+	cliPassword := flags.String("p", "", "the password (or set PICOCRYPT_PASSWORD)")
+	cliPasswordFile := flags.String("password-file", "", "read the password from `file` (\"-\" for stdin)")
+	flags.Var(&cliKeyfiles, "k", "use a keyfile at `path` (repeatable)")
+	cliDelete := flags.Bool("delete", false, "delete the input files after a successful operation")
+	cliOverwrite := flags.Bool("f", false, "overwrite the output if it already exists")
+
+	// Options that only apply to one mode
+	var cliOrdered, cliParanoid, cliReedsolo, cliCompress, cliRandomName, cliForce bool
+	var cliComments, cliCommentsFile, cliNotes, cliNotesFile, cliSplit, cliUnits, cliSigningKey string
+	var cliRecipients, cliIdentities, cliAddPasswords, cliAddPasswordFiles, cliTags stringList
+	var cliArgon2 *argon2Flags
+	var cliPad, cliRecovery, cliParityChunks uint
+	cliParity := uint(8)
+	var cliHidden bool
+	var cliHiddenPassword, cliHiddenPasswordFile, cliPadScheme string
+	if command == "encrypt" {
+		flags.BoolVar(&cliOrdered, "ordered", false, "require the correct order of keyfiles")
+		flags.StringVar(&cliComments, "comments", "", "store `text` as (unencrypted) comments")
+		flags.StringVar(&cliCommentsFile, "comments-file", "", "read the comments from `file`")
+		flags.StringVar(&cliNotes, "notes", "", "store `text` as encrypted notes, shown after decrypting")
+		flags.StringVar(&cliNotesFile, "notes-file", "", "read the encrypted notes from `file`")
+		flags.Var(&cliTags, "tag", "store a `key=value` tag in the header without encryption (repeatable)")
+		flags.BoolVar(&cliParanoid, "paranoid", false, "use paranoid mode")
+		flags.BoolVar(&cliReedsolo, "reedsolo", false, "encode the volume with Reed-Solomon")
+		flags.UintVar(&cliParity, "parity", 8, "Reed-Solomon parity `bytes` per 128 bytes of data: 8, 16, 32, or 64")
+		flags.BoolVar(&cliCompress, "compress", false, "compress files with Deflate before encrypting")
+		flags.UintVar(&cliRecovery, "recovery", 0, "also save <output>.parity, which can rebuild up to `percent` of the volume")
+		flags.BoolVar(&cliRandomName, "random-name", false, "give the volume a random name (the original is restored when decrypting)")
+		flags.StringVar(&cliSplit, "split", "", "split the output into chunks of `size` units")
+		flags.StringVar(&cliUnits, "units", "MiB", "chunk units: KiB, MiB, GiB, TiB, or Total")
+		flags.UintVar(&cliParityChunks, "parity-chunks", 0, "add `n` parity chunks, so that many lost chunks can be rebuilt")
+		flags.Var(&cliRecipients, "r", "encrypt to a public `key` or a file containing one (repeatable)")
+		flags.Var(&cliAddPasswords, "add-password", "also allow decrypting with `password` (repeatable)")
+		flags.Var(&cliAddPasswordFiles, "add-password-file", "also allow decrypting with the password in `file` (repeatable)")
+		cliArgon2 = addArgon2Flags(flags)
+		flags.StringVar(&cliSigningKey, "sign", "", "sign the volume with the signing key in `file`")
+		flags.BoolVar(&detached, "detached", false, "save the signature as <output>.sig instead of embedding it")
+		flags.UintVar(&cliPad, "pad", 0, "add `MiB` of random padding after the data")
+		flags.StringVar(&cliPadScheme, "pad-scheme", "", "hide the size with `scheme`: padme (at most 12% larger) or bucket (next power of two)")
+		flags.StringVar(&hiddenFile, "hidden", "", "hide `file` at the end of the padding")
+		flags.StringVar(&cliHiddenPassword, "hidden-password", "", "the `password` of the hidden file")
+		flags.StringVar(&cliHiddenPasswordFile, "hidden-password-file", "", "read the password of the hidden file from `file`")
+	} else {
+		flags.BoolVar(&cliForce, "force", false, "override security measures when decrypting")
+		flags.BoolVar(&repair, "repair", false, "write Reed-Solomon corrections back to a damaged volume")
+		flags.BoolVar(&rebuildChunks, "rebuild-chunks", false, "rebuild lost or damaged chunks of a split volume from its parity chunks")
+		flags.Var(&cliIdentities, "i", "decrypt with the identity in `file` (repeatable)")
+		flags.BoolVar(&cliHidden, "hidden", false, "decrypt the hidden volume that opens with the password")
+	}
+
+	if err := flags.Parse(args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			return exitSuccess
+		}
+		return exitUsage
+	}
+	names := flags.Args()
+	if len(names) == 0 {
+		flags.Usage()
+		return exitUsage
+	}
+
+	// Make sure all inputs exist before handing them to onDrop
+	stream := len(names) == 1 && names[0] == "-"
+	for i, name := range names {
+		if stream {
+			break
+		}
+		names[i], _ = filepath.Abs(name)
+		if _, err := os.Stat(names[i]); err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot access %s.\n", name)
+			return exitAccess
+		}
+	}
+
+	// Files go through work(), which can only write to files
+	if *cliOutput == "-" && !stream {
+		fmt.Fprintln(os.Stderr, "Only stdin can be decrypted to stdout.")
+		return exitUsage
+	}
+
+	// Get the password from the flag, a file, or the environment
+	if *cliPasswordFile == "-" && stream {
+		fmt.Fprintln(os.Stderr, "Stdin can't be used for both the password and the input.")
+		return exitUsage
+	}
+	if *cliPasswordFile != "" {
+		var err error
+		*cliPassword, err = readPassword(*cliPasswordFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Cannot read the password file.")
+			return exitAccess
+		}
+	} else if *cliPassword == "" {
+		*cliPassword = os.Getenv("PICOCRYPT_PASSWORD")
+	}
+
+	// Comments and encrypted notes can be long, so they can also come from a file
+	if cliCommentsFile != "" {
+		data, err := os.ReadFile(cliCommentsFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Cannot read the comments file.")
+			return exitAccess
+		}
+		cliComments = string(data)
+	}
+	if len(cliComments) > volume.MaxComments {
+		fmt.Fprintln(os.Stderr, "The comments are too long.")
+		return exitUsage
+	}
+	if cliNotesFile != "" {
+		data, err := os.ReadFile(cliNotesFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Cannot read the notes file.")
+			return exitAccess
+		}
+		cliNotes = string(data)
+	}
+
+	// Tags are given as key=value
+	for _, i := range cliTags {
+		j := strings.Index(i, "=")
+		if j <= 0 {
+			fmt.Fprintf(os.Stderr, "Invalid tag %s, use key=value.\n", i)
+			return exitUsage
+		}
+		tag := volume.Tag{Key: i[:j], Value: i[j+1:]}
+		if !tag.Valid() {
+			message, code := volumeError(volume.ErrInvalidTag)
+			fmt.Fprintln(os.Stderr, message)
+			return code
+		}
+		tags = append(tags, tag)
+	}
+
+	// Make sure the keyfiles are readable
+	paths, err := keyfilePaths(cliKeyfiles)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitAccess
+	}
+
+	// More passwords that can decrypt, like a recovery password
+	for _, i := range cliAddPasswords {
+		extraKeys = append(extraKeys, volume.Key{Password: i})
+	}
+	for _, i := range cliAddPasswordFiles {
+		extra, err := readPassword(i)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot read the password file %s.\n", i)
+			return exitAccess
+		}
+		extraKeys = append(extraKeys, volume.Key{Password: extra})
+	}
+
+	// Key derivation parameters other than the defaults
+	if cliArgon2 != nil {
+		argon2Custom, err = cliArgon2.params(cliParanoid)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitUsage
+		}
+	}
+
+	// Key to sign the volume with
+	if cliSigningKey != "" {
+		signingKey, err = readIdentity(cliSigningKey)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot read signing key %s.\n", cliSigningKey)
+			return exitAccess
+		}
+	} else if detached {
+		fmt.Fprintln(os.Stderr, "A signing key (-sign) is needed for a detached signature.")
+		return exitUsage
+	}
+
+	// Reed-Solomon parity
+	if cliParity != 8 && cliParity != 16 && cliParity != 32 && cliParity != 64 {
+		fmt.Fprintln(os.Stderr, "The parity (-parity) must be 8, 16, 32, or 64 bytes.")
+		return exitUsage
+	}
+	if cliParity != 8 && !cliReedsolo {
+		fmt.Fprintln(os.Stderr, "The parity (-parity) only applies with -reedsolo.")
+		return exitUsage
+	}
+
+	// Parity file or parity chunks saved along with the volume
+	if cliRecovery > 100 {
+		fmt.Fprintln(os.Stderr, "The recovery file (-recovery) can cover at most 100 percent.")
+		return exitUsage
+	}
+	if cliRecovery > 0 && cliSplit != "" {
+		fmt.Fprintln(os.Stderr, "Use -parity-chunks instead of -recovery for a split volume.")
+		return exitUsage
+	}
+	if cliParityChunks > 0 && cliSplit == "" {
+		fmt.Fprintln(os.Stderr, "Parity chunks (-parity-chunks) need -split.")
+		return exitUsage
+	}
+	if cliParityChunks > 255 {
+		fmt.Fprintln(os.Stderr, "There can be at most 256 chunks, including the parity chunks.")
+		return exitUsage
+	}
+	recovery = cliRecovery > 0 || cliParityChunks > 0
+	if cliRecovery > 0 {
+		recoveryPercent = int(cliRecovery)
+	}
+	recoveryChunks = int(cliParityChunks)
+
+	// Padding and the file hidden in it
+	padding = int64(cliPad) * int64(MiB)
+	switch strings.ToLower(cliPadScheme) {
+	case "", "none":
+	case "padme":
+		padScheme = volume.PadPadme
+	case "bucket":
+		padScheme = volume.PadBucket
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown padding scheme %s.\n", cliPadScheme)
+		return exitUsage
+	}
+	if hiddenFile != "" {
+		hiddenFile, _ = filepath.Abs(hiddenFile)
+		if stat, err := os.Stat(hiddenFile); err != nil || stat.IsDir() {
+			fmt.Fprintf(os.Stderr, "Cannot read the hidden file %s.\n", hiddenFile)
+			return exitAccess
+		}
+		if cliHiddenPasswordFile != "" {
+			if cliHiddenPassword, err = readPassword(cliHiddenPasswordFile); err != nil {
+				fmt.Fprintln(os.Stderr, "Cannot read the hidden password file.")
+				return exitAccess
+			}
+		}
+		if cliHiddenPassword == "" || cliHiddenPassword == *cliPassword {
+			fmt.Fprintln(os.Stderr, "The hidden file needs its own password (-hidden-password).")
+			return exitUsage
+		}
+		hiddenPassword = cliHiddenPassword
+
+		stat, _ := os.Stat(hiddenFile)
+		if padding < volume.HiddenSize(stat.Size()) {
+			fmt.Fprintf(os.Stderr, "The padding (-pad) must be at least %d MiB for the hidden file.\n",
+				(volume.HiddenSize(stat.Size())+int64(MiB)-1)/int64(MiB))
+			return exitUsage
+		}
+	}
+
+	// Public keys to encrypt to and identities to decrypt with
+	for _, i := range cliRecipients {
+		recipient, err := readRecipient(i)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid public key %s.\n", i)
+			return exitUsage
+		}
+		recipients = append(recipients, recipient)
+	}
+	for _, i := range cliIdentities {
+		identity, err := readIdentity(i)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot read identity %s.\n", i)
+			return exitAccess
+		}
+		identities = append(identities, identity)
+	}
+
+	// A hidden volume is read straight out of the outer one
+	if cliHidden {
+		if stream || len(names) != 1 {
+			fmt.Fprintln(os.Stderr, "A hidden volume is opened from a single volume file.")
+			return exitUsage
+		}
+		return cliDecryptHidden(names[0], *cliOutput, *cliOverwrite, volume.Key{Password: *cliPassword, Keyfiles: paths})
+	}
+
+	// Stdin can't go through work(), so use the volume package directly
+	if stream {
+		if *cliDelete || repair || rebuildChunks || cliCompress || cliSplit != "" || hiddenFile != "" {
+			fmt.Fprintln(os.Stderr, "Deleting, repairing, rebuilding, compressing, splitting, and hiding need files as input.")
+			return exitUsage
+		}
+		if *cliPassword == "" && len(paths) == 0 && recipients == nil && identities == nil && extraKeys == nil {
+			fmt.Fprintln(os.Stderr, "A password, keyfiles, or public keys are required.")
+			return exitUsage
+		}
+		return cliStream(command, *cliOutput, *cliOverwrite, &volume.Options{
+			Password:       *cliPassword,
+			Keyfiles:       paths,
+			KeyfileOrdered: cliOrdered,
+			Comments:       cliComments,
+			Notes:          cliNotes,
+			Tags:           tags,
+			Paranoid:       cliParanoid,
+			ReedSolomon:    cliReedsolo,
+			Parity:         int(cliParity),
+			Recipients:     recipients,
+			Keys:           extraKeys,
+			Argon2:         argon2Custom,
+			Signer:         signingKey,
+			Detached:       detached,
+			Padding:        padding,
+			PadScheme:      padScheme,
+			Force:          cliForce,
+			Identities:     identities,
+		})
+	}
+
+	// Select the inputs the same way as dropping them into the window
+	onDrop(names)
+	for scanning {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if mainStatusColor == RED && !(mode == "decrypt" && cliForce) {
+		fmt.Fprintln(os.Stderr, mainStatus)
+		return exitCode
+	}
+	if command == "encrypt" && mode == "decrypt" {
+		fmt.Fprintln(os.Stderr, "The input is already a Picocrypt volume.")
+		return exitUsage
+	}
+	if command == "decrypt" && mode != "decrypt" {
+		fmt.Fprintln(os.Stderr, "This doesn't seem like a Picocrypt volume.")
+		return exitFailure
+	}
+
+	password = *cliPassword
+	cpassword = password
+
+	// Keyfiles only apply if the volume uses them
+	if mode == "encrypt" || keyfile {
+		keyfiles = paths
+	}
+	if keyfile && keyfiles == nil && identities == nil {
+		fmt.Fprintln(os.Stderr, "Please select your keyfiles.")
+		return exitUsage
+	}
+	if password == "" && len(keyfiles) == 0 && recipients == nil && identities == nil && extraKeys == nil {
+		fmt.Fprintln(os.Stderr, "A password, keyfiles, or public keys are required.")
+		return exitUsage
+	}
+
+	if mode == "encrypt" {
+		keyfileOrdered = cliOrdered
+		comments = cliComments
+		notes = cliNotes
+		paranoid = cliParanoid
+		reedsolo = cliReedsolo
+		for i := range parityLevels {
+			if 8<<i == cliParity {
+				paritySelected = int32(i)
+			}
+		}
+		compress = cliCompress
+		if compress && !(len(allFiles) > 1 || len(onlyFolders) > 0) {
+			outputFile = filepath.Join(filepath.Dir(outputFile), "Encrypted") + ".zip.pcv"
+		}
+		randomName = cliRandomName
+		if randomName {
+			outputFile = randomOutput(outputFile)
+		}
+
+		// Validate the chunk size and units
+		if cliSplit != "" {
+			split = true
+			splitSize = cliSplit
+			splitSelected = -1
+			for i, j := range splitUnits {
+				if strings.EqualFold(j, cliUnits) {
+					splitSelected = int32(i)
+				}
+			}
+			tmp, err := strconv.Atoi(splitSize)
+			if splitSelected == -1 || tmp <= 0 || err != nil {
+				fmt.Fprintln(os.Stderr, "Invalid chunk size.")
+				return exitUsage
+			}
+		}
+	} else {
+		keep = cliForce
+	}
+	delete = *cliDelete
+	if *cliOutput != "" {
+		outputFile, _ = filepath.Abs(*cliOutput)
+		outputCustom = true
+	}
+
+	// Don't overwrite anything unless asked to
+	_, err = os.Stat(outputFile)
+	if split {
+		if !chunksExist(outputFile) {
+			err = os.ErrNotExist
+		}
+	}
+	if err == nil && !*cliOverwrite {
+		fmt.Fprintln(os.Stderr, "Output already exists. Use -f to overwrite.")
+		return exitFailure
+	}
+
+	// Cancel gracefully on Ctrl+C so partial files are cleaned up
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		working = false
+	}()
+
+	// Show the progress if attached to a terminal
+	finished := make(chan struct{})
+	cleared := make(chan struct{})
+	stat, _ := os.Stderr.Stat()
+	if stat != nil && stat.Mode()&os.ModeCharDevice != 0 {
+		go func() {
+			for {
+				select {
+				case <-finished:
+					fmt.Fprintf(os.Stderr, "\r%-60s\r", "")
+					close(cleared)
+					return
+				case <-time.After(100 * time.Millisecond):
+					fmt.Fprintf(os.Stderr, "\r%-60s", strings.TrimSpace(popupStatus+" "+progressInfo))
+				}
+			}
+		}()
+	} else {
+		close(cleared)
+	}
+
+	fastDecode = true
+	work()
+	working = false
+	close(finished)
+	<-cleared
+
+	fmt.Fprintln(os.Stderr, mainStatus)
+	if revealedNotes != "" {
+		fmt.Fprintf(os.Stderr, "Notes: %s\n", revealedNotes)
+	}
+	return exitCode
+}
+
+// Encrypt or decrypt stdin, which can't be handed to work() like a file
+func cliStream(command string, output string, overwrite bool, opts *volume.Options) int {
+	if output == "" {
+		fmt.Fprintln(os.Stderr, "An output (-o) is required when reading from stdin.")
+		return exitUsage
+	}
+
+	// Volumes are seeked back into once encrypted, so only decrypt to stdout
+	fout := os.Stdout
+	if output != "-" {
+		if _, err := os.Stat(output); err == nil && !overwrite {
+			fmt.Fprintln(os.Stderr, "Output already exists. Use -f to overwrite.")
+			return exitFailure
+		}
+		var err error
+		fout, err = os.Create(output)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Write access denied by operating system.")
+			return exitAccess
+		}
+	} else if command == "encrypt" {
+		fmt.Fprintln(os.Stderr, "Volumes can't be written to stdout.")
+		return exitUsage
+	}
+
+	var err error
+	var revealed string
+	if command == "encrypt" {
+		var writer *volume.Writer
+		writer, err = volume.NewWriter(fout, opts)
+		if err == nil {
+			_, err = io.CopyBuffer(writer, os.Stdin, make([]byte, MiB))
+		}
+		if err == nil {
+			err = writer.Close()
+		}
+		if err == nil && opts.Detached {
+			err = os.WriteFile(output+".sig", writer.Signature(), 0644)
+		}
+		if err == nil && recovery {
+			err = writeRecovery(output, output+".parity", recoveryPercent)
+		}
+	} else {
+		var reader *volume.Reader
+		reader, err = volume.NewReader(os.Stdin, opts)
+		if err == nil && output == "-" && reader.Header().Version < "v2" {
+			// Nothing can be taken back once it's written to stdout
+			fmt.Fprintln(os.Stderr, "Warning: volumes before v2 are only authenticated at the end, so don't trust the output unless this completes.")
+		}
+		if err == nil {
+			revealed = reader.Notes()
+			_, err = io.CopyBuffer(fout, reader, make([]byte, MiB))
+		}
+	}
+	if output != "-" {
+		fout.Close()
+	}
+
+	if err == volume.ErrModified && opts.Force {
+		fmt.Fprintln(os.Stderr, "The input file was modified. Please be careful.")
+		if revealed != "" {
+			fmt.Fprintf(os.Stderr, "Notes: %s\n", revealed)
+		}
+		return exitModified
+	}
+	if err != nil {
+		if output != "-" {
+			os.Remove(output)
+		}
+		message, code := volumeError(err)
+		fmt.Fprintln(os.Stderr, message)
+		return code
+	}
+	fmt.Fprintln(os.Stderr, "Completed.")
+	if revealed != "" {
+		fmt.Fprintf(os.Stderr, "Notes: %s\n", revealed)
+	}
+	return exitSuccess
+}
+
+// Decrypt the hidden volume inside another volume
+func cliDecryptHidden(name string, output string, overwrite bool, key volume.Key) int {
+	// The chunks of a split volume are read as one
+	if base := strings.TrimSuffix(name, ".0"); base != name {
+		if _, err := os.Stat(base); err != nil {
+			name = base
+		}
+	}
+	if output == "" {
+		output = strings.TrimSuffix(name, ".pcv")
+	}
+	if _, err := os.Stat(output); err == nil && !overwrite {
+		fmt.Fprintln(os.Stderr, "Output already exists. Use -f to overwrite.")
+		return exitFailure
+	}
+
+	fin, err := openVolume(name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot access %s.\n", name)
+		return exitAccess
+	}
+	defer fin.Close()
+	fout, err := os.Create(output)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Write access denied by operating system.")
+		return exitAccess
+	}
+	err = volume.DecryptHidden(fout, fin, key)
+	if cerr := fout.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(output)
+		message, code := volumeError(err)
+		fmt.Fprintln(os.Stderr, message)
+		return code
+	}
+	fmt.Fprintln(os.Stderr, "Completed.")
+	return exitSuccess
+}
+
+// Read the first line of a password file ("-" for stdin)
+func readPassword(path string) (string, error) {
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(strings.SplitN(string(data), "\n", 2)[0], "\r"), nil
+}
+
+// Get the absolute paths of readable keyfiles without duplicates
+func keyfilePaths(names []string) ([]string, error) {
+	var paths []string
+	for _, path := range names {
+		path, _ = filepath.Abs(path)
+		stat, err := os.Stat(path)
+		if err == nil && !stat.IsDir() {
+			var fin *os.File
+			fin, err = os.Open(path)
+			fin.Close()
+		}
+		if err != nil || stat.IsDir() {
+			return nil, fmt.Errorf("Cannot read keyfile %s.", path)
+		}
+		duplicate := false
+		for _, i := range paths {
+			if i == path {
+				duplicate = true
+			}
+		}
+		if !duplicate {
+			paths = append(paths, path)
+		}
+	}
+	return paths, nil
+}
+
+// Generate an identity for receiving volumes encrypted to its public key,
+// or a key for signing volumes
+func cliKeygen(args []string) int {
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: picocrypt keygen [options]")
+		flags.PrintDefaults()
+	}
+	cliOutput := flags.String("o", "", "save the identity as `path` instead of printing it")
+	cliOverwrite := flags.Bool("f", false, "overwrite the output if it already exists")
+	cliSigning := flags.Bool("sign", false, "generate a key for signing volumes instead")
+	if err := flags.Parse(args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			return exitSuccess
+		}
+		return exitUsage
+	}
+
+	kind := "identity"
+	private := volume.NewIdentity()
+	recipient, _ := volume.Recipient(private)
+	if *cliSigning {
+		kind = "signing key"
+		private = volume.NewSigningKey()
+		recipient, _ = volume.SigningPublicKey(private)
+	}
+	public := base64.StdEncoding.EncodeToString(recipient)
+	data := fmt.Sprintf(
+		"# Picocrypt %s, keep this file secret\n# Public key: %s\n%s\n",
+		kind, public, base64.StdEncoding.EncodeToString(private),
+	)
+
+	if *cliOutput == "" {
+		fmt.Print(data)
+		return exitSuccess
+	}
+	if _, err := os.Stat(*cliOutput); err == nil && !*cliOverwrite {
+		fmt.Fprintln(os.Stderr, "Output already exists. Use -f to overwrite.")
+		return exitFailure
+	}
+	if err := os.WriteFile(*cliOutput, []byte(data), 0600); err != nil {
+		fmt.Fprintln(os.Stderr, "Write access denied by operating system.")
+		return exitAccess
+	}
+	fmt.Println(public)
+	return exitSuccess
+}
+
+// Change the password, keyfiles, or public keys of a volume in place
+func cliRekey(args []string) int {
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: picocrypt rekey [options] <volume>")
+		flags.PrintDefaults()
+	}
+
+	// The keys that currently open the volume
+	var cliKeyfiles, cliIdentities stringList
+	cliPassword := flags.String("p", "", "the current password (or set PICOCRYPT_PASSWORD)")
+	cliPasswordFile := flags.String("password-file", "", "read the current password from `file` (\"-\" for stdin)")
+	flags.Var(&cliKeyfiles, "k", "use a current keyfile at `path` (repeatable)")
+	flags.Var(&cliIdentities, "i", "open the volume with the identity in `file` (repeatable)")
+
+	// The keys that will open it afterwards
+	var cliNewKeyfiles, cliRecipients, cliAddPasswords, cliAddPasswordFiles stringList
+	cliNewPassword := flags.String("new-password", "", "the new password (or set PICOCRYPT_NEW_PASSWORD)")
+	cliNewPasswordFile := flags.String("new-password-file", "", "read the new password from `file` (\"-\" for stdin)")
+	flags.Var(&cliNewKeyfiles, "new-k", "use a new keyfile at `path` (repeatable)")
+	cliOrdered := flags.Bool("new-ordered", false, "require the correct order of the new keyfiles")
+	flags.Var(&cliRecipients, "r", "encrypt to a public `key` or a file containing one (repeatable)")
+	flags.Var(&cliAddPasswords, "add-password", "also allow decrypting with `password` (repeatable)")
+	flags.Var(&cliAddPasswordFiles, "add-password-file", "also allow decrypting with the password in `file` (repeatable)")
+	cliArgon2 := addArgon2Flags(flags)
+
+	if err := flags.Parse(args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			return exitSuccess
+		}
+		return exitUsage
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return exitUsage
+	}
+	if *cliPasswordFile == "-" && *cliNewPasswordFile == "-" {
+		fmt.Fprintln(os.Stderr, "Stdin can't be used for both passwords.")
+		return exitUsage
+	}
+
+	// Get the passwords from the flags, files, or the environment
+	var err error
+	if *cliPasswordFile != "" {
+		if *cliPassword, err = readPassword(*cliPasswordFile); err != nil {
+			fmt.Fprintln(os.Stderr, "Cannot read the password file.")
+			return exitAccess
+		}
+	} else if *cliPassword == "" {
+		*cliPassword = os.Getenv("PICOCRYPT_PASSWORD")
+	}
+	if *cliNewPasswordFile != "" {
+		if *cliNewPassword, err = readPassword(*cliNewPasswordFile); err != nil {
+			fmt.Fprintln(os.Stderr, "Cannot read the new password file.")
+			return exitAccess
+		}
+	} else if *cliNewPassword == "" {
+		*cliNewPassword = os.Getenv("PICOCRYPT_NEW_PASSWORD")
+	}
+
+	current := &volume.Options{Password: *cliPassword}
+	next := &volume.Options{Password: *cliNewPassword, KeyfileOrdered: *cliOrdered}
+	if current.Keyfiles, err = keyfilePaths(cliKeyfiles); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitAccess
+	}
+	if next.Keyfiles, err = keyfilePaths(cliNewKeyfiles); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitAccess
+	}
+	for _, i := range cliIdentities {
+		identity, err := readIdentity(i)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot read identity %s.\n", i)
+			return exitAccess
+		}
+		current.Identities = append(current.Identities, identity)
+	}
+	for _, i := range cliRecipients {
+		recipient, err := readRecipient(i)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid public key %s.\n", i)
+			return exitUsage
+		}
+		next.Recipients = append(next.Recipients, recipient)
+	}
+	for _, i := range cliAddPasswords {
+		next.Keys = append(next.Keys, volume.Key{Password: i})
+	}
+	for _, i := range cliAddPasswordFiles {
+		extra, err := readPassword(i)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot read the password file %s.\n", i)
+			return exitAccess
+		}
+		next.Keys = append(next.Keys, volume.Key{Password: extra})
+	}
+	if current.Password == "" && current.Keyfiles == nil && current.Identities == nil {
+		fmt.Fprintln(os.Stderr, "The current password, keyfiles, or identity is required.")
+		return exitUsage
+	}
+	if next.Password == "" && next.Keyfiles == nil && next.Recipients == nil && next.Keys == nil {
+		fmt.Fprintln(os.Stderr, "A new password, keyfiles, or public keys are required.")
+		return exitUsage
+	}
+
+	// The header of a split volume can span several chunks, so they are
+	// opened as one
+	name := flags.Arg(0)
+	var f io.ReadWriteSeeker
+	if _, err = os.Stat(name); err != nil {
+		if _, err = os.Stat(name + ".0"); err == nil {
+			f, err = volume.OpenSplitFile(name)
+		}
+	} else {
+		f, err = os.OpenFile(name, os.O_RDWR, 0)
+	}
+	if err == volume.ErrChunkMissing {
+		message, code := volumeError(err)
+		fmt.Fprintln(os.Stderr, message)
+		return code
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot access %s.\n", flags.Arg(0))
+		return exitAccess
+	}
+
+	// The Argon2 flags start from the defaults of the volume's mode
+	h, err := volume.ReadHeader(f)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err == nil {
+		next.Argon2, err = cliArgon2.params(h.Paranoid)
+		if err != nil {
+			f.(io.Closer).Close()
+			fmt.Fprintln(os.Stderr, err)
+			return exitUsage
+		}
+		err = volume.Rekey(f, current, next)
+	}
+	if cerr := f.(io.Closer).Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		message, code := volumeError(err)
+		fmt.Fprintln(os.Stderr, message)
+		return code
+	}
+	fmt.Fprintln(os.Stderr, "Completed.")
+	if _, err := os.Stat(name + ".parity"); err == nil {
+		fmt.Fprintln(os.Stderr, "The parity file no longer matches the volume. Make a new one with \"picocrypt parity -f\".")
+	} else if _, err := os.Stat(name + ".p0"); err == nil {
+		fmt.Fprintln(os.Stderr, "The parity chunks no longer match the volume. Make new ones with \"picocrypt parity -f\".")
+	}
+	return exitSuccess
+}
+
+// Measure key derivation and encryption on this machine and recommend settings
+func cliBenchmark(args []string) int {
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: picocrypt benchmark [options]")
+		flags.PrintDefaults()
+	}
+	cliTarget := flags.Float64("target", 3, "longest acceptable key derivation in `seconds`")
+	cliMemory := flags.Uint("max-memory", 0, "don't let Argon2 use more than `MiB` (default: available memory, or 1 GiB if unknown)")
+	if err := flags.Parse(args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			return exitSuccess
+		}
+		return exitUsage
+	}
+	if *cliTarget <= 0 {
+		fmt.Fprintln(os.Stderr, "Invalid target time.")
+		return exitUsage
+	}
+	limit := uint32(*cliMemory * uint(KiB))
+	if limit == 0 {
+		limit = availableMemory()
+	}
+	if limit == 0 {
+		fmt.Fprintln(os.Stderr, "The available memory is unknown, so presets using more than the normal one are skipped. Use -max-memory to try them.")
+	}
+	target := time.Duration(*cliTarget * float64(time.Second))
+
+	// Try the presets from least to most memory, skipping any that won't fit
+	fmt.Println("Key derivation (Argon2id):")
+	presets := []struct {
+		name   string
+		params volume.Argon2
+	}{
+		{"low", volume.Argon2Low},
+		{"normal", volume.Argon2Normal},
+		{"paranoid", volume.Argon2Paranoid},
+		{"strong", volume.Argon2Strong},
+	}
+	recommended := ""
+	for _, p := range presets {
+		a := p.params
+		fmt.Printf("  %-9s %d passes, %d MiB, %d threads: ", p.name, a.Time, a.Memory/uint32(KiB), a.Threads)
+		if limit > 0 && a.Memory > limit {
+			fmt.Printf("skipped, only %d MiB available\n", limit/uint32(KiB))
+			continue
+		}
+		if limit == 0 && a.Memory > volume.Argon2Normal.Memory {
+			fmt.Println("skipped, available memory unknown")
+			continue
+		}
+		elapsed := volume.BenchmarkArgon2(a)
+		fmt.Printf("%.2f s\n", elapsed.Seconds())
+		if elapsed <= target && p.name != "paranoid" {
+			recommended = p.name
+		}
+	}
+
+	fmt.Println("Encryption:")
+	speeds := volume.Benchmark(500 * time.Millisecond)
+	for _, i := range []struct {
+		name  string
+		speed float64
+	}{
+		{"XChaCha20", speeds.XChaCha20},
+		{"Serpent-CTR", speeds.Serpent},
+		{"BLAKE2b", speeds.BLAKE2b},
+		{"HMAC-SHA3", speeds.HMACSHA3},
+		{"Reed-Solomon encoding", speeds.RSEncode},
+		{"Reed-Solomon decoding", speeds.RSDecode},
+	} {
+		fmt.Printf("  %-22s %8.2f MiB/s\n", i.name, i.speed)
+	}
+
+	fmt.Println("Expected throughput (without disk limits):")
+	for _, i := range []struct {
+		name     string
+		paranoid bool
+		reedsolo bool
+	}{
+		{"Normal", false, false},
+		{"Normal + Reed-Solomon", false, true},
+		{"Paranoid", true, false},
+		{"Paranoid + Reed-Solomon", true, true},
+	} {
+		fmt.Printf("  %-22s %8.2f MiB/s\n", i.name, speeds.Throughput(i.paranoid, i.reedsolo))
+	}
+
+	// Recommend the preset with the most memory that stays within the target
+	if recommended == "" {
+		fmt.Printf("Recommended: -argon2 low -calibrate %g (no preset finishes within %g s)\n", *cliTarget, *cliTarget)
+	} else {
+		fmt.Printf("Recommended: -argon2 %s, or add -calibrate %g to use all %g s\n", recommended, *cliTarget, *cliTarget)
+	}
+	return exitSuccess
+}
+
+// Get the memory available for new allocations in KiB, or 0 if unknown
+func availableMemory() uint32 {
+	data, err := os.ReadFile("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "MemAvailable:" {
+			kib, err := strconv.ParseUint(fields[1], 10, 32)
+			if err != nil {
+				return math.MaxUint32
+			}
+			return uint32(kib)
+		}
+	}
+	return 0
+}
+
+// Make a detached signature for an existing volume, which needs no password
+func cliSign(args []string) int {
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: picocrypt sign [options] <volume>")
+		flags.PrintDefaults()
+	}
+	cliKey := flags.String("key", "", "sign with the signing key in `file`")
+	cliOutput := flags.String("o", "", "save the signature as `path` (default: <volume>.sig)")
+	cliOverwrite := flags.Bool("f", false, "overwrite the output if it already exists")
+	if err := flags.Parse(args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			return exitSuccess
+		}
+		return exitUsage
+	}
+	if flags.NArg() != 1 || *cliKey == "" {
+		flags.Usage()
+		return exitUsage
+	}
+	key, err := readIdentity(*cliKey)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot read signing key %s.\n", *cliKey)
+		return exitAccess
+	}
+	output := *cliOutput
+	if output == "" {
+		output = flags.Arg(0) + ".sig"
+	}
+	if _, err := os.Stat(output); err == nil && !*cliOverwrite {
+		fmt.Fprintln(os.Stderr, "Output already exists. Use -f to overwrite.")
+		return exitFailure
+	}
+
+	fin, err := openVolume(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot access %s.\n", flags.Arg(0))
+		return exitAccess
+	}
+	signature, err := volume.Sign(fin, key)
+	fin.Close()
+	if err != nil {
+		message, code := volumeError(err)
+		fmt.Fprintln(os.Stderr, message)
+		return code
+	}
+	if err := os.WriteFile(output, signature, 0644); err != nil {
+		fmt.Fprintln(os.Stderr, "Write access denied by operating system.")
+		return exitAccess
+	}
+	fmt.Fprintln(os.Stderr, "Completed.")
+	return exitSuccess
+}
+
+// Check the signature of a volume against a trusted public key without decrypting it
+func cliVerify(args []string) int {
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: picocrypt verify [options] <volume>")
+		flags.PrintDefaults()
+	}
+	cliKey := flags.String("key", "", "the trusted public `key` or a file containing it")
+	cliSignature := flags.String("sig", "", "use the detached signature in `file` (default: <volume>.sig if it exists)")
+	if err := flags.Parse(args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			return exitSuccess
+		}
+		return exitUsage
+	}
+	if flags.NArg() != 1 || *cliKey == "" {
+		flags.Usage()
+		return exitUsage
+	}
+	public, err := readRecipient(*cliKey)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid public key %s.\n", *cliKey)
+		return exitUsage
+	}
+
+	// Prefer a detached signature, otherwise the one embedded in the volume
+	var signature []byte
+	path := *cliSignature
+	if path == "" {
+		if _, err := os.Stat(flags.Arg(0) + ".sig"); err == nil {
+			path = flags.Arg(0) + ".sig"
+		}
+	}
+	if path != "" {
+		if signature, err = os.ReadFile(path); err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot read the signature %s.\n", path)
+			return exitAccess
+		}
+	}
+
+	fin, err := openVolume(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot access %s.\n", flags.Arg(0))
+		return exitAccess
+	}
+	err = volume.Verify(fin, public, signature)
+	fin.Close()
+	if err != nil {
+		message, code := volumeError(err)
+		fmt.Fprintln(os.Stderr, message)
+		return code
+	}
+	fmt.Fprintln(os.Stderr, "The signature is valid.")
+	return exitSuccess
+}
+
+// Show what can be read from a volume without the password, such as its
+// comments and tags, so volumes can be indexed by other tools
+func cliInspect(args []string) int {
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: picocrypt inspect [options] <volume>")
+		flags.PrintDefaults()
+	}
+	cliJSON := flags.Bool("json", false, "print the details as JSON")
+	cliKey := flags.String("key", "", "check the embedded signature, which covers the tags, against a trusted public `key`")
+	if err := flags.Parse(args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			return exitSuccess
+		}
+		return exitUsage
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return exitUsage
+	}
+	var public []byte
+	if *cliKey != "" {
+		var err error
+		if public, err = readRecipient(*cliKey); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid public key %s.\n", *cliKey)
+			return exitUsage
+		}
+	}
+
+	fin, err := openVolume(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot access %s.\n", flags.Arg(0))
+		return exitAccess
+	}
+	defer fin.Close()
+	header, err := volume.ReadHeader(fin)
+	if header == nil {
+		message, code := volumeError(err)
+		fmt.Fprintln(os.Stderr, message)
+		return code
+	}
+	damaged := err != nil
+
+	// The signature covers the data too, so the whole volume is read
+	if public != nil {
+		fin.Seek(0, io.SeekStart)
+		if err := volume.Verify(fin, public, nil); err != nil {
+			message, code := volumeError(err)
+			fmt.Fprintln(os.Stderr, message)
+			return code
+		}
+	}
+
+	// Volumes before v2 don't have key slots, only a single password
+	passwords, recipients := header.Slots()
+	if header.Version < "v2" {
+		passwords = 1
+	}
+	type tag struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+	}
+	info := struct {
+		Version     string `json:"version"`
+		Comments    string `json:"comments"`
+		Damaged     bool   `json:"damaged"`
+		Paranoid    bool   `json:"paranoid"`
+		ReedSolomon bool   `json:"reedSolomon"`
+		Parity      int    `json:"parity,omitempty"`
+		Keyfiles    bool   `json:"keyfiles"`
+		Passwords   int    `json:"passwords"`
+		Recipients  int    `json:"recipients"`
+		Signed      bool   `json:"signed"`
+		Verified    bool   `json:"verified"`
+		Tags        []tag  `json:"tags"`
+	}{
+		Version:     header.Version,
+		Comments:    header.Comments,
+		Damaged:     damaged,
+		Paranoid:    header.Paranoid,
+		ReedSolomon: header.ReedSolomon,
+		Keyfiles:    header.Keyfiles,
+		Passwords:   passwords,
+		Recipients:  recipients,
+		Signed:      header.Signed(),
+		Verified:    public != nil,
+		Tags:        []tag{},
+	}
+	for _, i := range header.Tags {
+		info.Tags = append(info.Tags, tag{i.Key, i.Value})
+	}
+	if header.ReedSolomon {
+		info.Parity = header.Parity
+	}
+
+	if *cliJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(info)
+	} else {
+		var options []string
+		if info.Paranoid {
+			options = append(options, "paranoid")
+		}
+		if info.ReedSolomon {
+			options = append(options, fmt.Sprintf("Reed-Solomon (%d parity bytes per 128)", info.Parity))
+		}
+		if info.Keyfiles {
+			options = append(options, "keyfiles required")
+		}
+		signature := "none"
+		if info.Verified {
+			signature = "valid"
+		} else if info.Signed {
+			signature = "embedded (not checked, use -key)"
+		}
+		fmt.Printf("Version:    %s\n", info.Version)
+		fmt.Printf("Comments:   %s\n", info.Comments)
+		fmt.Printf("Options:    %s\n", strings.Join(options, ", "))
+		fmt.Printf("Key slots:  %d password(s), %d public key(s)\n", info.Passwords, info.Recipients)
+		fmt.Printf("Signature:  %s\n", signature)
+		fmt.Println("Tags:")
+		for _, i := range info.Tags {
+			fmt.Printf("  %s = %s\n", i.Key, i.Value)
+		}
+	}
+
+	if damaged {
+		fmt.Fprintln(os.Stderr, "The volume header is damaged.")
+		return exitDamaged
+	}
+	return exitSuccess
+}
+
+// Make a parity file for an existing volume, or rebuild the damaged parts of
+// a volume from its parity file. Split volumes get parity chunks instead.
+// Neither needs the password.
+func cliParity(args []string) int {
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: picocrypt parity [options] <volume>")
+		flags.PrintDefaults()
+	}
+	cliRedundancy := flags.Uint("redundancy", 10, "rebuild up to `percent` of the volume (1 to 100)")
+	cliOutput := flags.String("o", "", "the parity file at `path` (default: <volume>.parity)")
+	cliOverwrite := flags.Bool("f", false, "overwrite the parity file if it already exists")
+	cliRepair := flags.Bool("repair", false, "rebuild the damaged parts of the volume from the parity file")
+	cliChunks := flags.Uint("chunks", 1, "add `n` parity chunks to a split volume")
+	if err := flags.Parse(args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			return exitSuccess
+		}
+		return exitUsage
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return exitUsage
+	}
+	if *cliRedundancy < 1 || *cliRedundancy > 100 {
+		fmt.Fprintln(os.Stderr, "The redundancy must be 1 to 100 percent.")
+		return exitUsage
+	}
+	output := *cliOutput
+	if output == "" {
+		output = flags.Arg(0) + ".parity"
+	}
+
+	// A split volume is given by its name without the chunk number
+	name := flags.Arg(0)
+	if _, err := os.Stat(name); err != nil {
+		_, err := os.Stat(name + ".0")
+		_, parityErr := os.Stat(name + ".p0")
+		if err == nil || parityErr == nil {
+			return cliSplitParity(name, int(*cliChunks), *cliRepair, *cliOverwrite)
+		}
+	}
+
+	if !*cliRepair {
+		if _, err := os.Stat(output); err == nil && !*cliOverwrite {
+			fmt.Fprintln(os.Stderr, "Output already exists. Use -f to overwrite.")
+			return exitFailure
+		}
+		if _, err := os.Stat(flags.Arg(0)); err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot access %s.\n", flags.Arg(0))
+			return exitAccess
+		}
+		if err := writeRecovery(flags.Arg(0), output, int(*cliRedundancy)); err != nil {
+			message, code := volumeError(err)
+			fmt.Fprintln(os.Stderr, message)
+			return code
+		}
+		fmt.Fprintln(os.Stderr, "Completed.")
+		return exitSuccess
+	}
+
+	// The volume is rewritten in place
+	fin, err := os.OpenFile(flags.Arg(0), os.O_RDWR, 0)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot access %s.\n", flags.Arg(0))
+		return exitAccess
+	}
+	defer fin.Close()
+	parity, err := os.Open(output)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot read the parity file %s.\n", output)
+		return exitAccess
+	}
+	defer parity.Close()
+	repaired, err := volume.RepairParity(fin, parity)
+	if err != nil {
+		if repaired > 0 {
+			fmt.Fprintf(os.Stderr, "Rebuilt %d block(s), but some couldn't be rebuilt.\n", repaired)
+		}
+		message, code := volumeError(err)
+		fmt.Fprintln(os.Stderr, message)
+		return code
+	}
+	if repaired == 0 {
+		fmt.Fprintln(os.Stderr, "No damage found.")
+	} else {
+		fmt.Fprintf(os.Stderr, "Rebuilt %d block(s).\n", repaired)
+	}
+	return exitSuccess
+}
+
+// Make parity chunks for a split volume, or rebuild its lost or damaged chunks
+func cliSplitParity(name string, count int, repair bool, overwrite bool) int {
+	if repair {
+		rebuilt, err := volume.RepairSplit(name, true)
+		if err != nil {
+			message, code := volumeError(err)
+			fmt.Fprintln(os.Stderr, message)
+			return code
+		}
+		if len(rebuilt) == 0 {
+			fmt.Fprintln(os.Stderr, "No damage found.")
+		} else {
+			fmt.Fprintf(os.Stderr, "Rebuilt %d chunk(s).\n", len(rebuilt))
+		}
+		return exitSuccess
+	}
+
+	if _, err := os.Stat(name + ".p0"); err == nil && !overwrite {
+		fmt.Fprintln(os.Stderr, "Output already exists. Use -f to overwrite.")
+		return exitFailure
+	}
+	if count < 1 {
+		fmt.Fprintln(os.Stderr, "There must be at least one parity chunk.")
+		return exitUsage
+	}
+	if err := volume.WriteSplitParity(name, count); err != nil {
+		message, code := volumeError(err)
+		fmt.Fprintln(os.Stderr, message)
+		return code
+	}
+	fmt.Fprintln(os.Stderr, "Completed.")
+	return exitSuccess
+}
+
+// Correct a damaged volume in place with its Reed-Solomon codes, without the
+// password. Whatever they can't correct is rebuilt from the parity file.
+func cliRepair(args []string) int {
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: picocrypt repair [options] <volume>")
+		flags.PrintDefaults()
+	}
+	cliParityFile := flags.String("parity", "", "rebuild from the parity file at `path` (default: <volume>.parity if it exists)")
+	if err := flags.Parse(args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			return exitSuccess
+		}
+		return exitUsage
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return exitUsage
+	}
+	name := flags.Arg(0)
+	if _, err := os.Stat(name); err != nil {
+		if _, err := os.Stat(name + ".0"); err == nil {
+			fmt.Fprintln(os.Stderr, "Split volumes are repaired from their parity chunks with \"picocrypt parity -repair\".")
+			return exitUsage
+		}
+	}
+
+	fin, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot access %s.\n", name)
+		return exitAccess
+	}
+	defer fin.Close()
+	repaired, err := volume.Repair(fin)
+	if os.IsPermission(err) {
+		fmt.Fprintln(os.Stderr, "Write access denied by operating system.")
+		return exitAccess
+	}
+	if repaired.Header+repaired.Data > 0 {
+		fmt.Fprintf(os.Stderr, "Corrected %d header block(s) and %d data block(s).\n", repaired.Header, repaired.Data)
+	}
+
+	// The parity file also covers what Reed-Solomon doesn't, like the data
+	// of volumes without it, so it's always checked if there is one
+	output := *cliParityFile
+	if output == "" {
+		output = name + ".parity"
+	}
+	parity, parityErr := os.Open(output)
+	if parityErr != nil {
+		if *cliParityFile != "" {
+			fmt.Fprintf(os.Stderr, "Cannot read the parity file %s.\n", output)
+			return exitAccess
+		}
+		if err != nil {
+			message, code := volumeError(err)
+			fmt.Fprintln(os.Stderr, message)
+			return code
+		}
+		if repaired.Header+repaired.Data == 0 {
+			fmt.Fprintln(os.Stderr, "No damage found.")
+		}
+		return exitSuccess
+	}
+	defer parity.Close()
+	if _, err := fin.Seek(0, io.SeekStart); err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot access %s.\n", name)
+		return exitAccess
+	}
+	rebuilt, err := volume.RepairParity(fin, parity)
+	if err != nil {
+		if rebuilt > 0 {
+			fmt.Fprintf(os.Stderr, "Rebuilt %d block(s), but some couldn't be rebuilt.\n", rebuilt)
+		}
+		if os.IsPermission(err) {
+			fmt.Fprintln(os.Stderr, "Write access denied by operating system.")
+			return exitAccess
+		}
+		message, code := volumeError(err)
+		fmt.Fprintln(os.Stderr, message)
+		return code
+	}
+	if rebuilt > 0 {
+		fmt.Fprintf(os.Stderr, "Rebuilt %d block(s) from the parity file.\n", rebuilt)
+	} else if repaired.Header+repaired.Data == 0 {
+		fmt.Fprintln(os.Stderr, "No damage found.")
+	}
+	return exitSuccess
+}
+
+// Read the header of a split volume from its chunks up to the first missing one
+func splitHeader(name string) (*volume.Header, error) {
+	var chunks []io.Reader
+	for i := 0; ; i++ {
+		f, err := os.Open(fmt.Sprintf("%s.%d", name, i))
+		if err != nil {
+			break
+		}
+		defer f.Close()
+		chunks = append(chunks, f)
+	}
+	return volume.ReadHeader(io.MultiReader(chunks...))
+}
+
+// Open a volume, or the chunks of a split volume as one
+func openVolume(name string) (input, error) {
+	if _, err := os.Stat(name); err != nil {
+		if chunks, err := volume.NewSplitReader(name); err == nil {
+			return chunks, nil
+		}
+	}
+	return os.Open(name)
+}
+
+// Read the first key in a file, skipping comments and blank lines
+func readKey(data string) ([]byte, error) {
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(line)
+		if err != nil || len(key) != 32 {
+			break
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("no key found")
+}
+
+// Read an identity file made by "picocrypt keygen"
+func readIdentity(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return readKey(string(data))
+}
+
+// Get a public key given directly or as a file containing it
+func readRecipient(s string) ([]byte, error) {
+	if key, err := readKey(s); err == nil {
+		return key, nil
+	}
+	data, err := os.ReadFile(s)
+	if err != nil {
+		return nil, err
+	}
+
+	// Use the public key of an identity file, never the identity itself
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "# Public key: ") {
+			return readKey(strings.TrimPrefix(line, "# Public key: "))
+		}
+	}
+	return readKey(string(data))
+}
+
+func main() {
+	// Set DPI awareness to system aware (value of 1)
+	if runtime.GOOS == "windows" {
+		shcore := syscall.NewLazyDLL("Shcore.dll")
+		shproc := shcore.NewProc("SetProcessDpiAwareness")
+		shproc.Call(uintptr(1))
+	}
+
+	// Run headless if a command is given
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "encrypt", "decrypt":
+			os.Exit(cli(os.Args[1:]))
+		case "keygen":
+			os.Exit(cliKeygen(os.Args[1:]))
+		case "rekey":
+			os.Exit(cliRekey(os.Args[1:]))
+		case "sign":
+			os.Exit(cliSign(os.Args[1:]))
+		case "verify":
+			os.Exit(cliVerify(os.Args[1:]))
+		case "benchmark":
+			os.Exit(cliBenchmark(os.Args[1:]))
+		case "inspect":
+			os.Exit(cliInspect(os.Args[1:]))
+		case "parity":
+			os.Exit(cliParity(os.Args[1:]))
+		case "repair":
+			os.Exit(cliRepair(os.Args[1:]))
+		}
 	}
 
 	// Create the main window
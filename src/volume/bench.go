@@ -0,0 +1,94 @@
+package volume
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"time"
+
+	"github.com/HACKERALERT/crypto/blake2b"
+	"github.com/HACKERALERT/crypto/chacha20"
+	"github.com/HACKERALERT/crypto/sha3"
+	"github.com/HACKERALERT/serpent"
+)
+
+// Speeds of the primitives measured by Benchmark, in MiB/s
+type Speeds struct {
+	XChaCha20 float64
+	Serpent   float64 // Serpent in counter mode
+	BLAKE2b   float64 // Keyed BLAKE2b-512
+	HMACSHA3  float64 // HMAC-SHA3-512
+	RSEncode  float64 // Reed-Solomon encoding of the data (rs128)
+	RSDecode  float64 // Reed-Solomon decoding with error correction
+}
+
+// Benchmark measures how fast each primitive processes data on this
+// machine, spending about d on each one
+func Benchmark(d time.Duration) Speeds {
+	key := make([]byte, 32)
+	rand.Read(key)
+	src := make([]byte, MiB)
+	dst := make([]byte, MiB)
+	rand.Read(src)
+
+	var s Speeds
+	chacha, _ := chacha20.NewUnauthenticatedCipher(key, make([]byte, 24))
+	s.XChaCha20 = measure(d, func() {
+		chacha.XORKeyStream(dst, src)
+	})
+	block, _ := serpent.NewCipher(key)
+	ctr := cipher.NewCTR(block, make([]byte, 16))
+	s.Serpent = measure(d, func() {
+		ctr.XORKeyStream(dst, src)
+	})
+	b2, _ := blake2b.New512(key)
+	s.BLAKE2b = measure(d, func() {
+		b2.Write(src)
+	})
+	sha := hmac.New(sha3.New512, key)
+	s.HMACSHA3 = measure(d, func() {
+		sha.Write(src)
+	})
+	var encoded []byte
+	s.RSEncode = measure(d, func() {
+		encoded = interleave(encodeChunk(src, rs128), 136)
+	})
+	s.RSDecode = measure(d, func() {
+		decodeChunk(deinterleave(encoded, 136), rs128, false, false)
+	})
+	return s
+}
+
+// Throughput estimates how fast volumes can be encrypted with the given
+// options, in MiB/s, ignoring the speed of the disk
+func (s Speeds) Throughput(paranoid bool, reedSolomon bool) float64 {
+	seconds := 1 / s.XChaCha20
+	if paranoid {
+		seconds += 1/s.Serpent + 1/s.HMACSHA3
+	} else {
+		seconds += 1 / s.BLAKE2b
+	}
+	if reedSolomon {
+		seconds += 1 / s.RSEncode
+	}
+	return 1 / seconds
+}
+
+// Call fn, which processes 1 MiB, repeatedly for about d and return the speed in MiB/s
+func measure(d time.Duration, fn func()) float64 {
+	count := 0
+	start := time.Now()
+	for count == 0 || time.Since(start) < d {
+		fn()
+		count++
+	}
+	return float64(count) / time.Since(start).Seconds()
+}
+
+// BenchmarkArgon2 returns how long deriving a key with a takes on this machine.
+// Make sure there is enough free memory first since Argon2 allocates all of it.
+func BenchmarkArgon2(a Argon2) time.Duration {
+	start := time.Now()
+	deriveKey("", make([]byte, 16), a)
+	return time.Since(start)
+}
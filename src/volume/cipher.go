@@ -0,0 +1,174 @@
+package volume
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/binary"
+	"hash"
+	"io"
+
+	"github.com/HACKERALERT/crypto/blake2b"
+	"github.com/HACKERALERT/crypto/chacha20"
+	"github.com/HACKERALERT/crypto/chacha20poly1305"
+	"github.com/HACKERALERT/crypto/hkdf"
+	"github.com/HACKERALERT/crypto/sha3"
+	"github.com/HACKERALERT/serpent"
+)
+
+// The ciphers and MAC used for the encrypted data
+type ciphers struct {
+	key      []byte
+	paranoid bool
+	chunked  bool // Each chunk is authenticated on its own (v2 volumes)
+	chacha   *chacha20.Cipher
+	serpent  cipher.Stream
+	block    cipher.Block
+	mac      hash.Hash
+	hkdf     io.Reader
+	header   []byte // Subkey for the MAC of the header (v2 volumes)
+	entries  []byte // Subkey for encrypted entries (v2 volumes)
+	counter  int
+	chunks   uint64 // Number of chunks authenticated so far
+}
+
+// Set up the ciphers and MAC from the key and the header values
+func newCiphers(key []byte, h *Header) *ciphers {
+	c := &ciphers{key: key, paranoid: h.Paranoid, chunked: h.chunked()}
+	c.chacha, _ = chacha20.NewUnauthenticatedCipher(key, h.nonce)
+
+	// Use HKDF-SHA3 to generate a subkey for the MAC
+	subkey := make([]byte, 32)
+	c.hkdf = hkdf.New(sha3.New256, key, h.hkdfSalt, nil)
+	c.hkdf.Read(subkey)
+	if h.Paranoid {
+		c.mac = hmac.New(sha3.New512, subkey) // HMAC-SHA3
+	} else {
+		c.mac, _ = blake2b.New512(subkey) // Keyed BLAKE2b
+	}
+
+	// Generate another subkey for use as Serpent's key
+	serpentKey := make([]byte, 32)
+	c.hkdf.Read(serpentKey)
+	c.block, _ = serpent.NewCipher(serpentKey)
+	c.serpent = cipher.NewCTR(c.block, h.serpentIV)
+
+	// And more for the MAC of the header and the encrypted entries
+	if c.chunked {
+		c.header = make([]byte, 32)
+		c.hkdf.Read(c.header)
+		c.entries = make([]byte, 32)
+		c.hkdf.Read(c.entries)
+	}
+	return c
+}
+
+// Encrypt the value of an entry with XChaCha20-Poly1305, binding it to its type
+func (c *ciphers) sealEntry(kind byte, value []byte) []byte {
+	aead, _ := chacha20poly1305.NewX(c.entries)
+	nonce := make([]byte, 24)
+	rand.Read(nonce)
+	return aead.Seal(nonce, nonce, value, []byte{kind})
+}
+
+// Decrypt the value of an entry sealed by sealEntry
+func (c *ciphers) openEntry(kind byte, sealed []byte) ([]byte, error) {
+	if len(sealed) < 24 {
+		return nil, ErrHeaderDamaged
+	}
+	aead, _ := chacha20poly1305.NewX(c.entries)
+	return aead.Open(nil, sealed[:24], sealed[24:], []byte{kind})
+}
+
+// Encrypt a chunk of data and add it to the MAC
+func (c *ciphers) encrypt(dst []byte, src []byte) {
+	if c.paranoid {
+		c.serpent.XORKeyStream(dst, src)
+		copy(src, dst)
+	}
+	c.chacha.XORKeyStream(dst, src)
+	if !c.chunked {
+		c.mac.Write(dst)
+	}
+	c.advance()
+}
+
+// Add a chunk of data to the MAC and decrypt it
+func (c *ciphers) decrypt(dst []byte, src []byte) {
+	if !c.chunked {
+		c.mac.Write(src)
+	}
+	c.chacha.XORKeyStream(dst, src)
+	if c.paranoid {
+		copy(src, dst)
+		c.serpent.XORKeyStream(dst, src)
+	}
+	c.advance()
+}
+
+// Authenticate a chunk of encrypted data along with its position and whether
+// it is the final chunk, so chunks can't be reordered, dropped, or truncated
+func (c *ciphers) tag(data []byte, final bool) []byte {
+	info := make([]byte, 9)
+	binary.BigEndian.PutUint64(info, c.chunks)
+	if final {
+		info[8] = 1
+	}
+	c.chunks++
+
+	c.mac.Reset()
+	c.mac.Write(info)
+	c.mac.Write(data)
+	return c.mac.Sum(nil)
+}
+
+// Authenticate every value in the header, including the ones that aren't
+// secret like the version, comments, and flags
+func (c *ciphers) headerTag(h *Header) []byte {
+	var mac hash.Hash
+	if c.paranoid {
+		mac = hmac.New(sha3.New512, c.header)
+	} else {
+		mac, _ = blake2b.New512(c.header)
+	}
+
+	length := make([]byte, 8)
+	binary.BigEndian.PutUint64(length, uint64(len(h.Comments)))
+	for _, data := range [][]byte{
+		[]byte(h.Version),
+		length,
+		[]byte(h.Comments),
+		headerFlags(h),
+		h.salt,
+		h.hkdfSalt,
+		h.serpentIV,
+		h.nonce,
+		h.keyHash,
+		h.keyfileHash,
+		h.entries,
+	} {
+		mac.Write(data)
+	}
+	return mac.Sum(nil)
+}
+
+// Count the chunk and change nonce/IV after 60 GiB to prevent overflow
+func (c *ciphers) advance() {
+	c.counter += MiB
+	if c.counter < 60*GiB {
+		return
+	}
+
+	// ChaCha20
+	nonce := make([]byte, 24)
+	c.hkdf.Read(nonce)
+	c.chacha, _ = chacha20.NewUnauthenticatedCipher(c.key, nonce)
+
+	// Serpent
+	serpentIV := make([]byte, 16)
+	c.hkdf.Read(serpentIV)
+	c.serpent = cipher.NewCTR(c.block, serpentIV)
+
+	// Reset counter to 0
+	c.counter = 0
+}
@@ -0,0 +1,351 @@
+package volume
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/HACKERALERT/infectious"
+)
+
+// Reader decrypts a volume as it is read. In v2 volumes each chunk is
+// authenticated before it is decrypted, so Read never returns forged data
+// unless opts.Force is set. Older volumes can only be checked once all of
+// the data has been read, so nothing returned by Read is authentic until
+// Read returns io.EOF.
+type Reader struct {
+	chunks *chunkReader
+	h      *Header
+	c      *ciphers
+	opts   *Options
+	buf    []byte // Decrypted data not yet returned by Read
+	size   int64  // Size of the data before the padding (-1 if unknown)
+	meta   *Metadata
+	notes  string
+	done   int64 // Data returned so far
+	forced bool  // Damage or incorrect credentials were ignored
+	final  bool  // The final chunk has been read
+	err    error // Returned once buf is empty
+}
+
+// NewReader reads the header of a volume from r and checks the password and
+// keyfiles. If opts.Force is set, damage and incorrect credentials are
+// ignored and ErrModified is returned at the end instead of io.EOF.
+// Otherwise, ErrModified is returned as soon as a forged chunk is found.
+func NewReader(r io.Reader, opts *Options) (*Reader, error) {
+	v := &Reader{opts: opts}
+
+	// Read values from the header
+	h, err := ReadHeader(r)
+	if err == ErrHeaderDamaged && opts.Force {
+		v.forced = true
+	} else if err != nil {
+		return nil, err
+	}
+
+	// Get the file key from a key slot, which can't be forced
+	var key []byte
+	if h.chunked() {
+		key, err = openSlots(h, opts)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		if h.Keyfiles && len(opts.Keyfiles) == 0 {
+			return nil, ErrKeyfilesRequired
+		}
+
+		// Derive the key and validate the password and/or keyfiles
+		var keyHash, keyfileHash []byte
+		key, keyHash, keyfileHash, err = masterKey(h, opts)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkKey(h, keyHash, keyfileHash); err != nil {
+			if !opts.Force {
+				return nil, err
+			}
+			v.forced = true
+		}
+	}
+	v.h = h
+	v.c = newCiphers(key, h)
+
+	// Make sure nothing in the header has been changed
+	if h.chunked() && subtle.ConstantTimeCompare(v.c.headerTag(h), h.authTag) == 0 {
+		if !opts.Force {
+			return nil, ErrHeaderModified
+		}
+		v.forced = true
+	}
+
+	// Anything after the size of the data is padding
+	v.size = -1
+	if sealed := findEntry(h.entries, entrySize); sealed != nil {
+		size, err := v.c.openEntry(entrySize, sealed)
+		if err == nil && len(size) == 8 {
+			v.size = int64(binary.BigEndian.Uint64(size))
+		} else if !opts.Force {
+			return nil, ErrHeaderModified
+		} else {
+			v.forced = true
+		}
+	}
+
+	// The metadata of the original file, if it was stored
+	if sealed := findEntry(h.entries, entryMetadata); sealed != nil {
+		data, err := v.c.openEntry(entryMetadata, sealed)
+		if err == nil {
+			v.meta, err = decodeMetadata(data)
+		}
+		if err != nil && !opts.Force {
+			return nil, ErrHeaderModified
+		} else if err != nil {
+			v.forced = true
+		}
+	}
+
+	// The encrypted notes, if there are any
+	if sealed := findEntry(h.entries, entryNotes); sealed != nil {
+		notes, err := v.c.openEntry(entryNotes, sealed)
+		if err != nil && !opts.Force {
+			return nil, ErrHeaderModified
+		} else if err != nil {
+			v.forced = true
+		}
+		v.notes = string(notes)
+	}
+
+	v.chunks = newChunkReader(r, h, opts.FastDecode)
+	return v, nil
+}
+
+// Metadata returns the name, mode, and time of the original file, or nil
+// if they weren't stored
+func (v *Reader) Metadata() *Metadata {
+	return v.meta
+}
+
+// Notes returns the encrypted comments of the volume, which are empty if
+// there are none
+func (v *Reader) Notes() string {
+	return v.notes
+}
+
+// Header returns the header of the volume being read
+func (v *Reader) Header() *Header {
+	return v.h
+}
+
+// Read decrypts the next chunk of the volume whenever the previous one
+// has been consumed
+func (v *Reader) Read(p []byte) (int, error) {
+	for len(v.buf) == 0 {
+		if v.err != nil {
+			return 0, v.err
+		}
+		v.err = v.next()
+	}
+	n := copy(p, v.buf)
+	v.buf = v.buf[n:]
+	return n, nil
+}
+
+// Decrypt the next chunk into buf, returning an error once there is nothing left
+func (v *Reader) next() error {
+	data, tag, last, err := v.chunks.next()
+	if err == io.EOF {
+		return v.finish()
+	} else if err == errTruncated {
+		v.forced = true
+		return v.finish()
+	} else if err == ErrDamaged {
+		if !v.opts.Force {
+			return err
+		}
+		v.forced = true
+	} else if err != nil {
+		return err
+	}
+
+	// Don't release any data from a forged chunk
+	if tag != nil {
+		if subtle.ConstantTimeCompare(v.c.tag(data, last), tag) == 0 {
+			if !v.opts.Force {
+				return ErrModified
+			}
+			v.forced = true
+		}
+		v.final = last
+	}
+
+	v.buf = make([]byte, len(data))
+	v.c.decrypt(v.buf, data)
+
+	// Drop the padding, though its chunks are still authenticated
+	if v.size >= 0 {
+		if int64(len(v.buf)) > v.size-v.done {
+			v.buf = v.buf[:v.size-v.done]
+		}
+		v.done += int64(len(v.buf))
+	}
+	if last {
+		return v.finish()
+	}
+	return nil
+}
+
+// Validate the authenticity of decrypted data
+func (v *Reader) finish() error {
+	if v.h.chunked() {
+		if !v.final || v.forced {
+			return ErrModified
+		}
+		return io.EOF
+	}
+	if subtle.ConstantTimeCompare(v.c.mac.Sum(nil), v.h.authTag) == 0 || v.forced {
+		return ErrModified
+	}
+	return io.EOF
+}
+
+// Decrypt reads a volume from r and writes the decrypted data to w. If
+// opts.Force is set, damage and incorrect credentials are ignored and
+// ErrModified is returned once everything has been written.
+func Decrypt(w io.Writer, r io.Reader, opts *Options) error {
+	v, err := NewReader(r, opts)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyBuffer(w, v, make([]byte, MiB))
+	return err
+}
+
+// A chunk too short to hold its tag, which means the volume was truncated
+var errTruncated = errors.New("volume: truncated chunk")
+
+// chunkReader reads the encrypted chunks of a volume that follow the
+// header, along with their tags, and decodes them from Reed-Solomon
+type chunkReader struct {
+	r          *bufio.Reader
+	h          *Header
+	size       int    // Size of an encrypted chunk (plus parity with Reed-Solomon, and its tag)
+	tag        int    // Size of the tag after each chunk
+	src        []byte // Encrypted chunk being read
+	fastDecode bool
+}
+
+func newChunkReader(r io.Reader, h *Header, fastDecode bool) *chunkReader {
+	c := &chunkReader{r: bufio.NewReader(r), h: h, fastDecode: fastDecode}
+
+	// Encrypted data is read in 1 MiB chunks (plus parity with Reed-Solomon)
+	c.size = MiB
+	if h.ReedSolomon {
+		c.size = MiB / 128 * (128 + h.Parity)
+	}
+	if h.chunked() {
+		c.tag = 64
+		if h.ReedSolomon {
+			c.tag = 192
+		}
+		c.size += c.tag
+	}
+	c.src = make([]byte, c.size)
+	return c
+}
+
+// Read the next chunk and its tag (nil before v2), and whether it is the
+// last one. The data is still returned with ErrDamaged if Reed-Solomon
+// couldn't correct it, and io.EOF is returned once there is nothing left.
+func (c *chunkReader) next() ([]byte, []byte, bool, error) {
+	read, err := io.ReadFull(c.r, c.src)
+	if err == io.EOF {
+		return nil, nil, false, io.EOF
+	} else if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, nil, false, err
+	}
+	data := c.src[:read]
+
+	// Check if this is the last chunk, which may be padded
+	last := read < c.size
+	if !last {
+		if _, err := c.r.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return nil, nil, false, err
+		}
+	}
+
+	// Split off the tag of the chunk
+	var tag []byte
+	if c.h.chunked() {
+		if len(data) < c.tag {
+			return nil, nil, false, errTruncated
+		}
+		data, tag = data[:len(data)-c.tag], data[len(data)-c.tag:]
+		if c.h.ReedSolomon {
+			tag, _ = rsDecode(rs64, tag, false)
+		}
+	}
+
+	if c.h.ReedSolomon {
+		if c.h.Interleaved {
+			data = deinterleave(data, 128+c.h.Parity)
+		}
+		data, err = decodeChunk(data, dataFEC[c.h.Parity], last && c.h.Padded, c.fastDecode)
+		return data, tag, last, err
+	}
+	return data, tag, last, nil
+}
+
+// Decode a chunk of Reed-Solomon encoded data, removing the padding from the
+// final block if the chunk is partial or 'padded' is set
+func decodeChunk(src []byte, rs *infectious.FEC, padded bool, fastDecode bool) ([]byte, error) {
+	var dst []byte
+	var damaged error
+	size := rs.Total()
+
+	// If a complete 1 MiB block is available
+	if len(src) == MiB/128*size {
+		// Decode every chunk
+		for i := 0; i < MiB/128*size; i += size {
+			tmp, err := rsDecode(rs, src[i:i+size], fastDecode)
+			if err != nil {
+				damaged = ErrDamaged
+			}
+			if i == MiB/128*size-size && padded {
+				tmp = unpad(tmp)
+			}
+			dst = append(dst, tmp...)
+		}
+		return dst, damaged
+	}
+
+	// A truncated volume won't have whole blocks
+	if len(src)%size != 0 {
+		damaged = ErrDamaged
+		src = src[:len(src)/size*size]
+		if len(src) == 0 {
+			return nil, damaged
+		}
+	}
+
+	// Decode the full chunks
+	chunks := len(src)/size - 1
+	for i := 0; i < chunks; i++ {
+		tmp, err := rsDecode(rs, src[i*size:(i+1)*size], fastDecode)
+		if err != nil {
+			damaged = ErrDamaged
+		}
+		dst = append(dst, tmp...)
+	}
+
+	// Unpad and decode the final partial chunk
+	tmp, err := rsDecode(rs, src[chunks*size:], fastDecode)
+	if err != nil {
+		damaged = ErrDamaged
+	}
+	return append(dst, unpad(tmp)...), damaged
+}
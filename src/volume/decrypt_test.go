@@ -0,0 +1,61 @@
+package volume
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestTamperedChunks(t *testing.T) {
+	data := randomBytes(2*MiB + 1000)
+	opts := &Options{Password: "password", Argon2: &testArgon2}
+	f := encrypt(t, data, opts)
+	start := int(readHeader(t, f).Size())
+	chunk := MiB + 64
+
+	tests := []struct {
+		name   string
+		change func(v []byte) []byte
+		good   int // Bytes of plaintext that may be released before the error
+	}{
+		{"flipped byte", func(v []byte) []byte {
+			v[start+chunk+10] ^= 1
+			return v
+		}, MiB},
+		{"flipped tag", func(v []byte) []byte {
+			v[start+chunk-1] ^= 1
+			return v
+		}, 0},
+		{"truncated", func(v []byte) []byte {
+			return v[:len(v)-10]
+		}, 2 * MiB},
+		{"final chunk dropped", func(v []byte) []byte {
+			return v[:start+2*chunk]
+		}, 2 * MiB},
+		{"chunk dropped", func(v []byte) []byte {
+			return append(v[:start+chunk], v[start+2*chunk:]...)
+		}, MiB},
+		{"chunks swapped", func(v []byte) []byte {
+			first := append([]byte{}, v[start:start+chunk]...)
+			copy(v[start:], v[start+chunk:start+2*chunk])
+			copy(v[start+chunk:], first)
+			return v
+		}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tampered := &memFile{data: tt.change(append([]byte{}, f.data...))}
+			out, err := decrypt(tampered, &Options{Password: "password"})
+			if err != ErrModified {
+				t.Fatalf("got %v, want ErrModified", err)
+			}
+			if len(out) > tt.good || !bytes.Equal(out, data[:len(out)]) {
+				t.Errorf("released %d bytes before the damage, want at most %d authentic ones", len(out), tt.good)
+			}
+
+			// Forcing still decrypts what it can
+			if _, err := decrypt(tampered, &Options{Password: "password", Force: true}); err != ErrModified {
+				t.Errorf("forced: got %v, want ErrModified", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,401 @@
+package volume
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+
+	"github.com/HACKERALERT/infectious"
+)
+
+// Errors for options that can't be encrypted with
+var (
+	ErrInvalidParity  = errors.New("volume: Reed-Solomon parity must be 8, 16, 32, or 64 bytes")
+	ErrHeaderFull     = errors.New("volume: the notes and tags don't fit in the header")
+	ErrInvalidPadding = errors.New("volume: invalid padding")
+	ErrHiddenTooLarge = errors.New("volume: the padding is too small for the hidden volume")
+)
+
+// Writer encrypts everything written to it into a volume. The length of the
+// data doesn't need to be known in advance, Close finishes the volume.
+type Writer struct {
+	w      io.WriteSeeker // Must be seekable since the MAC is written into the header
+	start  int64          // Offset of the volume in w
+	h      *Header
+	c      *ciphers
+	buf    []byte // Data waiting for a full 1 MiB chunk
+	raw    int    // Offset in buf where already encrypted data starts (-1 for none)
+	total  int64
+	err    error
+	closed bool
+
+	// Padding after the data, which may hold a hidden volume
+	padding int64
+	scheme  int
+	hidden  *Hidden
+
+	// Signing
+	signer    *signer
+	key       []byte // Ed25519 signing key
+	detached  bool
+	signature []byte
+}
+
+// NewWriter writes the header of a new volume to w and returns a Writer
+// for the data to encrypt
+func NewWriter(w io.WriteSeeker, opts *Options) (*Writer, error) {
+	start, err := w.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+
+	// Configure the header and fill values with Go's CSPRNG
+	h := &Header{
+		Version:        Version,
+		Comments:       opts.Comments,
+		Tags:           opts.Tags,
+		Paranoid:       opts.Paranoid,
+		Keyfiles:       len(opts.Keyfiles) > 0,
+		KeyfileOrdered: opts.KeyfileOrdered,
+		ReedSolomon:    opts.ReedSolomon,
+		Interleaved:    opts.ReedSolomon,
+		Parity:         opts.Parity,
+		salt:           make([]byte, 16),
+		hkdfSalt:       make([]byte, 32),
+		serpentIV:      make([]byte, 16),
+		nonce:          make([]byte, 24),
+	}
+	rand.Read(h.salt)
+	rand.Read(h.hkdfSalt)
+	rand.Read(h.serpentIV)
+	rand.Read(h.nonce)
+	if len(opts.Comments) > MaxComments {
+		return nil, ErrCommentsTooLong
+	}
+	if h.Parity == 0 {
+		h.Parity = 8
+	}
+	if dataFEC[h.Parity] == nil {
+		return nil, ErrInvalidParity
+	}
+	for _, t := range opts.Tags {
+		if !t.Valid() {
+			return nil, ErrInvalidTag
+		}
+	}
+
+	// Encrypt a random file key for each password and recipient
+	key := make([]byte, 32)
+	rand.Read(key)
+	slots, err := newSlots(key, h, opts)
+	if err != nil {
+		return nil, err
+	}
+	h.slots = slots
+	entries := encodeSlots(slots)
+	h.keyHash, h.keyfileHash = make([]byte, 64), make([]byte, 32)
+
+	// Leave room for the size of the data and an embedded signature, which
+	// are filled in by Close
+	entries = appendEntry(entries, entrySize, make([]byte, 24+8+16))
+	if opts.Signer != nil {
+		if _, err := SigningPublicKey(opts.Signer); err != nil {
+			return nil, err
+		}
+		if !opts.Detached {
+			entries = appendEntry(entries, entrySignature, make([]byte, signatureSize))
+		}
+	}
+
+	// Encrypt the metadata of the file and the notes along with the data
+	c := newCiphers(key, h)
+	if opts.Metadata != nil {
+		entries = appendEntry(entries, entryMetadata, c.sealEntry(entryMetadata, opts.Metadata.encode()))
+	}
+	if opts.Notes != "" {
+		entries = appendEntry(entries, entryNotes, c.sealEntry(entryNotes, []byte(opts.Notes)))
+	}
+	for _, t := range opts.Tags {
+		entries = appendEntry(entries, entryTag, t.encode())
+	}
+	h.entries = padEntries(entries, reservedEntries)
+	if len(h.entries) > maxEntries {
+		return nil, ErrHeaderFull
+	}
+
+	// A hidden volume takes up the end of the padding
+	if opts.Padding < 0 || opts.PadScheme < PadNone || opts.PadScheme > PadBucket {
+		return nil, ErrInvalidPadding
+	}
+	if opts.Hidden != nil && HiddenSize(opts.Hidden.Size) > opts.Padding {
+		return nil, ErrHiddenTooLarge
+	}
+
+	// The padded flag is rewritten once the size is known
+	if err := writeHeader(w, h); err != nil {
+		return nil, err
+	}
+
+	v := &Writer{
+		w:       w,
+		start:   start,
+		h:       h,
+		c:       c,
+		buf:     make([]byte, 0, MiB),
+		raw:     -1,
+		padding: opts.Padding,
+		scheme:  opts.PadScheme,
+		hidden:  opts.Hidden,
+	}
+	if opts.Signer != nil {
+		v.signer = newSigner()
+		v.key = opts.Signer
+		v.detached = opts.Detached
+	}
+	return v, nil
+}
+
+// Write encrypts data in 1 MiB chunks as they fill up. A full chunk is only
+// written once more data arrives since the final chunk is authenticated differently.
+func (v *Writer) Write(p []byte) (int, error) {
+	if v.closed {
+		return 0, errors.New("volume: write to closed Writer")
+	}
+	if v.err != nil {
+		return 0, v.err
+	}
+	return v.write(p, false)
+}
+
+// Buffer data for encryption, or data that is already encrypted if raw is
+// set, which is written out as is in place of the ciphertext
+func (v *Writer) write(p []byte, raw bool) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(v.buf) == MiB {
+			if v.err = v.flush(false); v.err != nil {
+				return written, v.err
+			}
+		}
+		if raw && v.raw < 0 {
+			v.raw = len(v.buf)
+		}
+
+		n := copy(v.buf[len(v.buf):MiB], p)
+		v.buf = v.buf[:len(v.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Encrypt the buffered data and write it out
+func (v *Writer) flush(final bool) error {
+	dst := make([]byte, len(v.buf))
+	var raw []byte
+	if v.raw >= 0 {
+		raw = append(raw, v.buf[v.raw:]...)
+	}
+	v.c.encrypt(dst, v.buf)
+	if raw != nil {
+		copy(dst[v.raw:], raw) // The keystream is still used up
+		v.raw = 0
+	}
+	v.total += int64(len(v.buf))
+	v.buf = v.buf[:0]
+
+	var tag []byte
+	if v.c.chunked {
+		tag = v.c.tag(dst, final)
+	}
+	if v.signer != nil {
+		v.signer.chunk(dst, tag)
+	}
+	if v.h.ReedSolomon {
+		dst = encodeChunk(dst, dataFEC[v.h.Parity])
+		if v.h.Interleaved {
+			dst = interleave(dst, 128+v.h.Parity)
+		}
+		if tag != nil {
+			tag = rsEncode(rs64, tag)
+		}
+	}
+	_, err := v.w.Write(append(dst, tag...))
+	return err
+}
+
+// Close encrypts the final chunk and writes the values that are only known
+// at the end into the header. It doesn't close the underlying writer.
+func (v *Writer) Close() error {
+	if v.closed {
+		return v.err
+	}
+	v.closed = true
+	if v.err != nil {
+		return v.err
+	}
+
+	// Record the size of the data so the padding can be removed
+	size := v.total + int64(len(v.buf))
+	if v.c.chunked {
+		tmp := make([]byte, 8)
+		binary.BigEndian.PutUint64(tmp, uint64(size))
+		setEntry(v.h.entries, entrySize, v.c.sealEntry(entrySize, tmp))
+	}
+
+	// Pad with random bytes, followed by the hidden volume if there is one
+	padding := padSize(size+v.padding, v.scheme) - size
+	if v.hidden != nil {
+		padding -= HiddenSize(v.hidden.Size)
+	}
+	random := make([]byte, MiB)
+	for padding > 0 {
+		n := int64(len(random))
+		if padding < n {
+			n = padding
+		}
+		rand.Read(random[:n])
+		if _, v.err = v.write(random[:n], false); v.err != nil {
+			return v.err
+		}
+		padding -= n
+	}
+	if v.hidden != nil {
+		if v.err = v.writeHidden(); v.err != nil {
+			return v.err
+		}
+	}
+
+	// The final chunk is always written so truncation can be detected
+	if len(v.buf) > 0 || v.c.chunked {
+		if v.err = v.flush(true); v.err != nil {
+			return v.err
+		}
+	}
+
+	// Reed-Solomon internals
+	v.h.Padded = v.total%int64(MiB) >= int64(MiB)-128
+
+	// Sign once everything the signature covers is known
+	if v.signer != nil {
+		v.signature = v.signer.sign(v.h, v.key)
+		if !v.detached {
+			setEntry(v.h.entries, entrySignature, v.signature)
+		}
+	}
+
+	// Seek back to header and write important values
+	end, err := v.w.Seek(0, io.SeekCurrent)
+	if err != nil {
+		v.err = err
+		return err
+	}
+	if v.c.chunked {
+		v.h.authTag = v.c.headerTag(v.h)
+	} else {
+		v.h.authTag = v.c.mac.Sum(nil)
+	}
+	if err := writeHeaderTail(v.w, v.start, v.h); err != nil {
+		v.err = err
+		return err
+	}
+	if v.c.chunked { // Volumes before v2 have no entries
+		if err := writeEntriesAt(v.w, v.start, v.h); err != nil {
+			v.err = err
+			return err
+		}
+	}
+	_, v.err = v.w.Seek(end, io.SeekStart)
+	return v.err
+}
+
+// Signature returns the public key and signature of the volume after Close
+// if it was signed, which is the detached signature if opts.Detached was set
+func (v *Writer) Signature() []byte {
+	return v.signature
+}
+
+// Encrypt reads data from r until EOF and writes it to w as a volume
+func Encrypt(w io.WriteSeeker, r io.Reader, opts *Options) error {
+	v, err := NewWriter(w, opts)
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyBuffer(v, r, make([]byte, MiB)); err != nil {
+		return err
+	}
+	return v.Close()
+}
+
+// EncryptedSize returns the size of a volume holding size bytes of data
+func EncryptedSize(size int64, opts *Options) int64 {
+	total := 789 + commentsSize(Version, len(opts.Comments))
+
+	// Key slots for the passwords and each recipient
+	passwords := len(opts.Keys)
+	if passwordSlot(opts) {
+		passwords++
+	}
+	entries := passwords*(5+1+16+9+24+64+32+48) + len(opts.Recipients)*(5+32+24+48)
+	entries += 5 + 24 + 8 + 16
+	if opts.Metadata != nil {
+		entries += 5 + 24 + 12 + len(opts.Metadata.Name) + 16
+	}
+	if opts.Notes != "" {
+		entries += 5 + 24 + len(opts.Notes) + 16
+	}
+	for _, t := range opts.Tags {
+		entries += 5 + 1 + len(t.Key) + len(t.Value)
+	}
+	if opts.Signer != nil && !opts.Detached {
+		entries += 5 + signatureSize
+	}
+	if entries < reservedEntries {
+		entries = reservedEntries
+	}
+	total += int64(24 + (entries+63)/64*192)
+	size = padSize(size+opts.Padding, opts.PadScheme)
+	chunks := (size + int64(MiB) - 1) / int64(MiB)
+	if chunks == 0 {
+		chunks = 1 // An empty final chunk is still authenticated
+	}
+	if !opts.ReedSolomon {
+		return total + size + chunks*64
+	}
+
+	// Full chunks are encoded as is, the final partial one is padded
+	block := int64(128 + opts.Parity)
+	if opts.Parity == 0 {
+		block = 136
+	}
+	total += size / int64(MiB) * (int64(MiB) / 128 * block)
+	if rest := size % int64(MiB); rest > 0 || size == 0 {
+		total += (rest/128 + 1) * block
+	}
+	return total + chunks*192
+}
+
+// Encode a chunk of encrypted data with Reed-Solomon
+func encodeChunk(src []byte, rs *infectious.FEC) []byte {
+	var dst []byte
+
+	// If a full MiB is available
+	if len(src) == MiB {
+		// Encode every chunk
+		for i := 0; i < MiB; i += 128 {
+			dst = append(dst, rsEncode(rs, src[i:i+128])...)
+		}
+		return dst
+	}
+
+	// Encode the full chunks
+	chunks := math.Floor(float64(len(src)) / 128)
+	for i := 0; float64(i) < chunks; i++ {
+		dst = append(dst, rsEncode(rs, src[i*128:(i+1)*128])...)
+	}
+
+	// Pad and encode the final partial chunk
+	return append(dst, rsEncode(rs, pad(src[int(chunks*128):]))...)
+}
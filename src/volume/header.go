@@ -0,0 +1,366 @@
+package volume
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+
+	"github.com/HACKERALERT/infectious"
+)
+
+// Header holds the values stored at the start of a volume
+type Header struct {
+	Version  string
+	Comments string
+	Tags     []Tag // Since v2
+
+	// Flags
+	Paranoid       bool // XChaCha20 cascaded with Serpent, HMAC-SHA3
+	Keyfiles       bool // Keyfiles are required to decrypt
+	KeyfileOrdered bool // Order of keyfiles matters
+	ReedSolomon    bool // Encrypted data is encoded with Reed-Solomon
+	Interleaved    bool // Reed-Solomon codewords are spread across each chunk (since v2)
+	Parity         int  // Reed-Solomon parity bytes per 128-byte block of data (8 before v2)
+	Padded         bool // Final Reed-Solomon chunk was padded to a full MiB
+
+	// Set if the comments couldn't be corrected, they are left empty
+	CommentsDamaged bool
+
+	commentsLength int
+	salt           []byte // Argon2 salt, 16 bytes
+	hkdfSalt       []byte // HKDF-SHA3 salt, 32 bytes
+	serpentIV      []byte // Serpent IV, 16 bytes
+	nonce          []byte // 24-byte XChaCha20 nonce
+	keyHash        []byte // SHA3-512 hash of encryption key
+	keyfileHash    []byte // SHA3-256 of keyfile key
+	authTag        []byte // 64-byte authentication tag (BLAKE2b or HMAC-SHA3), of the header since v2
+	entries        []byte // Entries after the header since v2, padded to 64 bytes
+	slots          []*slot
+}
+
+// MaxComments is the longest comments can be in bytes since v2, which also
+// avoids huge allocations from a damaged header (before v2, 99999)
+const MaxComments = 1 << 24
+
+// Limit on the size of the entries to avoid huge allocations from a damaged header
+const maxEntries = 1 << 24
+
+// ErrCommentsTooLong is returned when the comments don't fit in the header
+var ErrCommentsTooLong = errors.New("volume: comments are too long")
+
+// Room for the entries of new volumes so more key slots fit when rekeying
+const reservedEntries = 512
+
+// Volumes before v2 are authenticated as a whole instead of chunk by chunk
+func (h *Header) chunked() bool {
+	return h.Version[1] >= '2'
+}
+
+// Size of the encoded header in bytes
+func (h *Header) Size() int64 {
+	size := 789 + commentsSize(h.Version, h.commentsLength)
+	if h.chunked() {
+		size += int64(24 + len(h.entries)/64*192)
+	}
+	return size
+}
+
+// Slots returns the number of password and recipient key slots
+func (h *Header) Slots() (passwords int, recipients int) {
+	for _, s := range h.slots {
+		if s.kind == entryPassword {
+			passwords++
+		} else {
+			recipients++
+		}
+	}
+	return passwords, recipients
+}
+
+// Signed returns whether a signature is embedded in the volume
+func (h *Header) Signed() bool {
+	return findEntry(h.entries, entrySignature) != nil
+}
+
+// Size of length bytes of encoded comments. Before v2, each byte takes up
+// three, and since v2 they are encoded in blocks of 128 like the data.
+func commentsSize(version string, length int) int64 {
+	if version[1] < '2' {
+		return int64(length) * 3
+	}
+	return int64((length+127)/128) * 136
+}
+
+// ReadHeader reads and decodes the header at the start of a volume. If some
+// values can't be corrected, the header is still returned with ErrHeaderDamaged.
+func ReadHeader(r io.Reader) (*Header, error) {
+	h := &Header{}
+	damaged := false
+
+	// Use regex to test if the input is a valid Picocrypt volume
+	version := make([]byte, 15)
+	if _, err := io.ReadFull(r, version); err != nil {
+		return nil, ErrNotVolume
+	}
+	version, err := rsDecode(rs5, version, false)
+	if valid, _ := regexp.Match(`^v\d\.\d{2}`, version); !valid {
+		return nil, ErrNotVolume
+	}
+	damaged = damaged || err != nil
+	h.Version = string(version)
+
+	// Read comments and check for corruption
+	tmp := make([]byte, 15)
+	if _, err := io.ReadFull(r, tmp); err != nil {
+		return nil, err
+	}
+	tmp, err = rsDecode(rs5, tmp, false)
+	h.CommentsDamaged = err != nil
+	damaged = damaged || err != nil
+	if h.chunked() {
+		// The length is a 5-byte big-endian number since v2
+		length := uint64(0)
+		for _, i := range tmp {
+			length = length<<8 | uint64(i)
+		}
+		if length > MaxComments {
+			return h, ErrHeaderDamaged
+		}
+		h.commentsLength = int(length)
+	} else {
+		h.commentsLength, err = strconv.Atoi(string(tmp))
+		if err != nil || h.commentsLength < 0 {
+			return h, ErrHeaderDamaged
+		}
+	}
+
+	tmp = make([]byte, commentsSize(h.Version, h.commentsLength))
+	if _, err := io.ReadFull(r, tmp); err != nil {
+		return nil, err
+	}
+	comments := make([]byte, 0, len(tmp))
+	if h.chunked() {
+		for i := 0; i < len(tmp) && !h.CommentsDamaged; i += 136 {
+			t, err := rsDecode(rs128, tmp[i:i+136], false)
+			if err != nil {
+				h.CommentsDamaged = true
+			}
+			comments = append(comments, t...)
+		}
+	} else {
+		for i := 0; i < len(tmp) && !h.CommentsDamaged; i += 3 {
+			t, err := rsDecode(rs1, tmp[i:i+3], false)
+			if err != nil {
+				h.CommentsDamaged = true
+			}
+			comments = append(comments, t...)
+		}
+	}
+	if !h.CommentsDamaged {
+		h.Comments = string(comments[:h.commentsLength])
+	}
+
+	// Read flags and the cryptographic values
+	var flags []byte
+	fields := []struct {
+		data *[]byte
+		rs   *infectious.FEC
+	}{
+		{&flags, rs5},
+		{&h.salt, rs16},
+		{&h.hkdfSalt, rs32},
+		{&h.serpentIV, rs16},
+		{&h.nonce, rs24},
+		{&h.keyHash, rs64},
+		{&h.keyfileHash, rs32},
+		{&h.authTag, rs64},
+	}
+	for _, field := range fields {
+		tmp := make([]byte, field.rs.Total())
+		if _, err := io.ReadFull(r, tmp); err != nil {
+			return nil, err
+		}
+		*field.data, err = rsDecode(field.rs, tmp, false)
+		damaged = damaged || err != nil
+	}
+	h.Paranoid = flags[0] == 1
+	h.Keyfiles = flags[1] == 1
+	h.KeyfileOrdered = flags[2] == 1
+	h.ReedSolomon = flags[3]&1 == 1
+	h.Interleaved = flags[3]&2 != 0 && h.ReedSolomon && h.chunked()
+	h.Parity = 8
+	if h.ReedSolomon && h.chunked() {
+		h.Parity <<= flags[3] >> 2 & 3
+	}
+	h.Padded = flags[4] == 1
+
+	// Read the entries that follow the header since v2
+	if h.chunked() {
+		tmp := make([]byte, 24)
+		if _, err := io.ReadFull(r, tmp); err != nil {
+			return nil, err
+		}
+		tmp, err = rsDecode(rs8, tmp, false)
+		size := binary.BigEndian.Uint64(tmp)
+		if err != nil || size%64 != 0 || size > maxEntries {
+			return h, ErrHeaderDamaged
+		}
+
+		tmp = make([]byte, size/64*192)
+		if _, err := io.ReadFull(r, tmp); err != nil {
+			return nil, err
+		}
+		for i := 0; i < len(tmp); i += 192 {
+			entry, err := rsDecode(rs64, tmp[i:i+192], false)
+			damaged = damaged || err != nil
+			h.entries = append(h.entries, entry...)
+		}
+		h.slots, err = decodeSlots(h.entries)
+		damaged = damaged || err != nil
+		h.Tags, err = decodeTags(h.entries)
+		damaged = damaged || err != nil
+	}
+
+	if damaged {
+		return h, ErrHeaderDamaged
+	}
+	return h, nil
+}
+
+// Write the header with placeholders for the values only known at the end
+func writeHeader(w io.Writer, h *Header) error {
+	h.commentsLength = len(h.Comments)
+	comments, length := encodeComments(h)
+
+	for _, data := range [][]byte{
+		rsEncode(rs5, []byte(h.Version)),
+		rsEncode(rs5, length),
+		comments,
+		rsEncode(rs5, headerFlags(h)),
+		rsEncode(rs16, h.salt),
+		rsEncode(rs32, h.hkdfSalt),
+		rsEncode(rs16, h.serpentIV),
+		rsEncode(rs24, h.nonce),
+		make([]byte, 192), // Hash of encryption key
+		make([]byte, 96),  // Hash of keyfile key
+		make([]byte, 192), // BLAKE2b/HMAC-SHA3 tag
+	} {
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	if !h.chunked() {
+		return nil
+	}
+
+	return writeEntries(w, h)
+}
+
+// Encode the comments and their length, which is zero-padded text before
+// v2. Since v2, the comments are padded with zeros to blocks of 128 bytes,
+// which is much smaller and leaves room for far longer comments.
+func encodeComments(h *Header) ([]byte, []byte) {
+	var comments []byte
+	if !h.chunked() {
+		for _, i := range []byte(h.Comments) {
+			comments = append(comments, rsEncode(rs1, []byte{i})...)
+		}
+		return comments, []byte(fmt.Sprintf("%05d", len(h.Comments)))
+	}
+
+	data := []byte(h.Comments)
+	if len(data)%128 != 0 {
+		data = append(data, make([]byte, 128-len(data)%128)...)
+	}
+	for i := 0; i < len(data); i += 128 {
+		comments = append(comments, rsEncode(rs128, data[i:i+128])...)
+	}
+	length := make([]byte, 8)
+	binary.BigEndian.PutUint64(length, uint64(len(h.Comments)))
+	return comments, length[3:]
+}
+
+// Write the entries that follow the header since v2
+func writeEntries(w io.Writer, h *Header) error {
+	size := make([]byte, 8)
+	binary.BigEndian.PutUint64(size, uint64(len(h.entries)))
+	if _, err := w.Write(rsEncode(rs8, size)); err != nil {
+		return err
+	}
+	for i := 0; i < len(h.entries); i += 64 {
+		if _, err := w.Write(rsEncode(rs64, h.entries[i:i+64])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Seek to the entries of the header at start and rewrite them
+func writeEntriesAt(w io.WriteSeeker, start int64, h *Header) error {
+	if _, err := w.Seek(start+789+commentsSize(h.Version, h.commentsLength), io.SeekStart); err != nil {
+		return err
+	}
+	return writeEntries(w, h)
+}
+
+// Pad entries with zeros to at least size bytes and a multiple of 64
+func padEntries(entries []byte, size int) []byte {
+	if len(entries) < size {
+		entries = append(entries, make([]byte, size-len(entries))...)
+	}
+	if len(entries)%64 != 0 {
+		entries = append(entries, make([]byte, 64-len(entries)%64)...)
+	}
+	return entries
+}
+
+// Encode the flags into bytes
+func headerFlags(h *Header) []byte {
+	flags := make([]byte, 5)
+	for i, j := range []bool{h.Paranoid, h.Keyfiles, h.KeyfileOrdered, h.ReedSolomon, h.Padded} {
+		if j {
+			flags[i] = 1
+		}
+	}
+
+	// The layout and amount of Reed-Solomon parity are stored with the flag
+	if h.Interleaved {
+		flags[3] |= 2
+	}
+	if h.ReedSolomon {
+		for i := byte(0); i < 4; i++ {
+			if h.Parity == 8<<i {
+				flags[3] |= i << 2
+			}
+		}
+	}
+	return flags
+}
+
+// Write the values that are only known after encrypting into the header
+func writeHeaderTail(w io.WriteSeeker, start int64, h *Header) error {
+	// The padded flag depends on the size of the data
+	if _, err := w.Seek(start+30+commentsSize(h.Version, h.commentsLength), io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := w.Write(rsEncode(rs5, headerFlags(h))); err != nil {
+		return err
+	}
+
+	if _, err := w.Seek(start+309+commentsSize(h.Version, h.commentsLength), io.SeekStart); err != nil {
+		return err
+	}
+	for _, data := range [][]byte{
+		rsEncode(rs64, h.keyHash),
+		rsEncode(rs32, h.keyfileHash),
+		rsEncode(rs64, h.authTag),
+	} {
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
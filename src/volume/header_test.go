@@ -0,0 +1,92 @@
+package volume
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Rewrite the header of a volume after changing it, leaving the tag as it was
+func rewriteHeader(t *testing.T, f *memFile, change func(h *Header)) *memFile {
+	t.Helper()
+	h := readHeader(t, f)
+	size := h.Size()
+	change(h)
+	out := &memFile{data: append([]byte{}, f.data...)}
+	if err := writeHeader(out, h); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeHeaderTail(out, 0, h); err != nil {
+		t.Fatal(err)
+	}
+	if h.Size() != size {
+		t.Fatalf("header is %d bytes instead of %d", h.Size(), size)
+	}
+	return out
+}
+
+func TestHeaderModified(t *testing.T) {
+	data := randomBytes(1000)
+	opts := &Options{Password: "password", Argon2: &testArgon2, Comments: "comments", Tags: []Tag{{TagOwner, "me"}}}
+	f := encrypt(t, data, opts)
+
+	tests := []struct {
+		name   string
+		change func(h *Header)
+		err    error
+	}{
+		{"nothing", func(h *Header) {}, nil},
+		{"comments", func(h *Header) { h.Comments = "COMMENTS" }, ErrHeaderModified},
+		{"flags", func(h *Header) { h.KeyfileOrdered = true }, ErrHeaderModified},
+		{"salt", func(h *Header) { h.salt[0] ^= 1 }, ErrHeaderModified},
+		{"tag", func(h *Header) {
+			i := bytes.Index(h.entries, []byte("me"))
+			copy(h.entries[i:], "us")
+		}, ErrHeaderModified},
+		{"padding of the entries", func(h *Header) { h.entries[len(h.entries)-1] = 1 }, ErrHeaderModified},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			modified := rewriteHeader(t, f, tt.change)
+			out, err := decrypt(modified, &Options{Password: "password"})
+			if err != tt.err {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if err == nil && !bytes.Equal(out, data) {
+				t.Fatal("decrypted data differs")
+			}
+
+			// Forcing decrypts the data but still reports the change
+			if tt.err != nil {
+				out, err := decrypt(modified, &Options{Password: "password", Force: true})
+				if err != ErrModified || !bytes.Equal(out, data) {
+					t.Errorf("forced: got %d bytes and %v, want the data and ErrModified", len(out), err)
+				}
+			}
+		})
+	}
+}
+
+func TestReadHeader(t *testing.T) {
+	f := encrypt(t, nil, &Options{Password: "password", Argon2: &testArgon2, Paranoid: true, ReedSolomon: true, Parity: 16})
+	h := readHeader(t, f)
+	if h.Version != Version || !h.Paranoid || !h.ReedSolomon || !h.Interleaved || h.Parity != 16 || h.Keyfiles {
+		t.Errorf("header is %+v", h)
+	}
+	if h.Size() > int64(len(f.data)) {
+		t.Errorf("Size = %d, volume is %d bytes", h.Size(), len(f.data))
+	}
+
+	if _, err := ReadHeader(bytes.NewReader(randomBytes(1000))); err != ErrNotVolume {
+		t.Errorf("random data: got %v, want ErrNotVolume", err)
+	}
+	if _, err := ReadHeader(bytes.NewReader(f.data[:100])); err == nil {
+		t.Error("truncated header was read")
+	}
+
+	// Before v2, the comments length was a decimal number
+	v1 := encryptV1(t, randomBytes(1000), "password", v1Header("", false, false))
+	copy(v1[15:], rsEncode(rs5, []byte("-0001")))
+	if _, err := ReadHeader(bytes.NewReader(v1)); err != ErrHeaderDamaged {
+		t.Errorf("negative comments length: got %v, want ErrHeaderDamaged", err)
+	}
+}
@@ -0,0 +1,286 @@
+package volume
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+
+	"github.com/HACKERALERT/crypto/chacha20poly1305"
+)
+
+// Hidden is a volume stored at the end of the padding of another one. The
+// padding is random, and so is every byte of the hidden volume, so without
+// its password nobody can tell that it exists, not even with the password
+// of the outer volume.
+type Hidden struct {
+	Key  Key       // Password and keyfiles of the hidden volume
+	Data io.Reader // Contents of the hidden volume
+	Size int64     // Exact number of bytes in Data
+}
+
+// The hidden header is the Argon2 salt, a nonce, and the sealed file key,
+// data nonce, and size of the data
+const hiddenHeaderSize = 16 + 24 + 32 + 24 + 8 + 16
+
+// HiddenSize returns how much of the padding a hidden volume of size bytes
+// takes up, since it is sealed in 1 MiB chunks and followed by its header
+func HiddenSize(size int64) int64 {
+	chunks := (size + int64(MiB) - 1) / int64(MiB)
+	if chunks == 0 {
+		chunks = 1 // An empty final chunk is still sealed
+	}
+	return size + chunks*16 + hiddenHeaderSize
+}
+
+// Hidden volumes use the Argon2 parameters of the outer volume's first
+// password slot. Storing their own would give them away, or let guesses of
+// the password be checked without running Argon2, so instead Rekey keeps the
+// first slot's parameters on volumes with padding. Any slot's parameters are
+// still tried when opening.
+func hiddenArgon2(h *Header) []Argon2 {
+	var params []Argon2
+	a, _ := argon2Params(nil, h.Paranoid)
+	for _, s := range append(h.slots, &slot{kind: entryPassword, argon2: a}) {
+		duplicate := false
+		for _, i := range params {
+			duplicate = duplicate || i == s.argon2
+		}
+		if s.kind == entryPassword && !duplicate {
+			params = append(params, s.argon2)
+		}
+	}
+	return params
+}
+
+// The nonce of each chunk is the data nonce XORed with the chunk's index
+func hiddenNonce(nonce []byte, index uint64) []byte {
+	tmp := append([]byte{}, nonce...)
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, index)
+	for i, j := range counter {
+		tmp[16+i] ^= j
+	}
+	return tmp
+}
+
+// Seal the hidden volume in chunks with XChaCha20-Poly1305 and write it
+// as is in place of the ciphertext at the end of the padding. The header
+// comes last so it can be found from the end of the volume.
+func (v *Writer) writeHidden() error {
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	kek, _, _, err := passwordKey(v.hidden.Key, salt, hiddenArgon2(v.h)[0], len(v.hidden.Key.Keyfiles) > 0)
+	if err != nil {
+		return err
+	}
+	key := make([]byte, 32)
+	nonce := make([]byte, 24)
+	rand.Read(key)
+	rand.Read(nonce)
+	aead, _ := chacha20poly1305.NewX(key)
+
+	// The final chunk is marked so a hidden volume can't be truncated
+	buf := make([]byte, MiB)
+	remaining := v.hidden.Size
+	for index := uint64(0); ; index++ {
+		n := int64(MiB)
+		if remaining < n {
+			n = remaining
+		}
+		if _, err := io.ReadFull(v.hidden.Data, buf[:n]); err != nil {
+			return err
+		}
+		remaining -= n
+		final := []byte{0}
+		if remaining == 0 {
+			final[0] = 1
+		}
+		if _, err := v.write(aead.Seal(nil, hiddenNonce(nonce, index), buf[:n], final), true); err != nil {
+			return err
+		}
+		if remaining == 0 {
+			break
+		}
+	}
+
+	// Seal the file key, nonce, and size with the key from the password
+	size := make([]byte, 8)
+	binary.BigEndian.PutUint64(size, uint64(v.hidden.Size))
+	plain := append(append(append([]byte{}, key...), nonce...), size...)
+	header := append([]byte{}, salt...)
+	wrapNonce, wrapped := wrapKey(kek, plain)
+	header = append(header, wrapNonce...)
+	_, err = v.write(append(header, wrapped...), true)
+	return err
+}
+
+// DecryptHidden finds the hidden volume in r that opens with k and writes
+// its contents to w. Since a hidden volume can't be told apart from random
+// padding, ErrIncorrectPassword is returned if there is none.
+func DecryptHidden(w io.Writer, r io.ReadSeeker, k Key) error {
+	start, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	h, err := ReadHeader(r)
+	if err != nil {
+		return err
+	}
+	if !h.chunked() {
+		return ErrIncorrectPassword
+	}
+	chunks, err := newChunkFile(r, start, h)
+	if err != nil {
+		return err
+	}
+
+	// The header is at the very end of the encrypted data
+	if chunks.total < hiddenHeaderSize {
+		return ErrIncorrectPassword
+	}
+	header := make([]byte, hiddenHeaderSize)
+	if err := chunks.readAt(header, chunks.total-hiddenHeaderSize); err != nil {
+		return err
+	}
+	var plain []byte
+	for _, a := range hiddenArgon2(h) {
+		kek, _, _, err := passwordKey(k, header[:16], a, len(k.Keyfiles) > 0)
+		if err != nil {
+			return err
+		}
+		if plain, err = unwrapKey(kek, header[16:40], header[40:]); err == nil {
+			break
+		}
+	}
+	if plain == nil {
+		return ErrIncorrectPassword
+	}
+	aead, _ := chacha20poly1305.NewX(plain[:32])
+	nonce := plain[32:56]
+	size := int64(binary.BigEndian.Uint64(plain[56:]))
+	if size < 0 || size > chunks.total || HiddenSize(size) > chunks.total {
+		return ErrDamaged
+	}
+
+	// Open each chunk before releasing its contents
+	offset := chunks.total - HiddenSize(size)
+	buf := make([]byte, MiB+16)
+	remaining := size
+	for index := uint64(0); ; index++ {
+		n := int64(MiB)
+		if remaining < n {
+			n = remaining
+		}
+		if err := chunks.readAt(buf[:n+16], offset); err != nil {
+			return err
+		}
+		offset += n + 16
+		remaining -= n
+		final := []byte{0}
+		if remaining == 0 {
+			final[0] = 1
+		}
+		data, err := aead.Open(nil, hiddenNonce(nonce, index), buf[:n+16], final)
+		if err != nil {
+			return ErrModified
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		if remaining == 0 {
+			return nil
+		}
+	}
+}
+
+// chunkFile reads the encrypted data of a volume at any offset, without
+// the tags and Reed-Solomon parity, by seeking to the chunk that holds it
+type chunkFile struct {
+	r     io.ReadSeeker
+	h     *Header
+	base  int64 // Offset of the first chunk in r
+	size  int   // Size of an encoded chunk with its tag
+	tag   int
+	count int64  // Number of chunks
+	total int64  // Size of the encrypted data
+	index int64  // Chunk in data
+	data  []byte // Decoded data of a chunk
+}
+
+func newChunkFile(r io.ReadSeeker, start int64, h *Header) (*chunkFile, error) {
+	end, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	c := &chunkFile{r: r, h: h, base: start + h.Size(), index: -1}
+	c.size = MiB
+	if h.ReedSolomon {
+		c.size = MiB / 128 * (128 + h.Parity)
+	}
+	c.tag = 64
+	if h.ReedSolomon {
+		c.tag = 192
+	}
+	c.size += c.tag
+	if end > c.base {
+		c.count = (end - c.base + int64(c.size) - 1) / int64(c.size)
+	}
+
+	// Only the last chunk can be shorter than 1 MiB
+	if c.count > 0 {
+		if err := c.load(c.count - 1); err != nil {
+			return nil, err
+		}
+		c.total = (c.count-1)*int64(MiB) + int64(len(c.data))
+	}
+	return c, nil
+}
+
+// Read and decode a chunk, leaving any damage to be caught by the caller
+func (c *chunkFile) load(index int64) error {
+	if index == c.index {
+		return nil
+	}
+	if _, err := c.r.Seek(c.base+index*int64(c.size), io.SeekStart); err != nil {
+		return err
+	}
+	src := make([]byte, c.size)
+	read, err := io.ReadFull(c.r, src)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	data := src[:read]
+	if len(data) < c.tag {
+		data = nil
+	} else {
+		data = data[:len(data)-c.tag]
+	}
+	if c.h.ReedSolomon && len(data) > 0 {
+		if c.h.Interleaved {
+			data = deinterleave(data, 128+c.h.Parity)
+		}
+		data, _ = decodeChunk(data, dataFEC[c.h.Parity], index == c.count-1 && c.h.Padded, false)
+	}
+	c.data, c.index = data, index
+	return nil
+}
+
+// Fill p with the encrypted data at offset
+func (c *chunkFile) readAt(p []byte, offset int64) error {
+	for len(p) > 0 {
+		if offset >= c.total {
+			return io.ErrUnexpectedEOF
+		}
+		if err := c.load(offset / int64(MiB)); err != nil {
+			return err
+		}
+		start := offset % int64(MiB)
+		if start >= int64(len(c.data)) {
+			return io.ErrUnexpectedEOF
+		}
+		n := copy(p, c.data[start:])
+		p = p[n:]
+		offset += int64(n)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package volume
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHidden(t *testing.T) {
+	keyfile := filepath.Join(t.TempDir(), "keyfile")
+	if err := os.WriteFile(keyfile, randomBytes(100), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		size    int
+		padding int
+		opts    Options
+		key     Key
+	}{
+		{"empty", 0, 1000, Options{}, Key{Password: "hidden"}},
+		{"small", 1000, 5000, Options{}, Key{Password: "hidden"}},
+		{"several chunks", MiB + 100, 2 * MiB, Options{}, Key{Password: "hidden"}},
+		{"keyfiles", 1000, 5000, Options{}, Key{Password: "hidden", Keyfiles: []string{keyfile}}},
+		{"paranoid", 1000, 5000, Options{Paranoid: true}, Key{Password: "hidden"}},
+		{"reed-solomon", MiB + 100, 2 * MiB, Options{ReedSolomon: true}, Key{Password: "hidden"}},
+		{"padding scheme", 1000, 5000, Options{PadScheme: PadBucket}, Key{Password: "hidden"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, hidden := randomBytes(1000), randomBytes(tt.size)
+			opts := tt.opts
+			opts.Password = "password"
+			opts.Padding = int64(tt.padding)
+			opts.Hidden = &Hidden{Key: tt.key, Data: bytes.NewReader(hidden), Size: int64(tt.size)}
+			f := encrypt(t, data, &opts)
+
+			// The outer volume opens as usual
+			if out, err := decrypt(f, &Options{Password: "password"}); err != nil || !bytes.Equal(out, data) {
+				t.Fatalf("outer volume: got %d bytes and %v", len(out), err)
+			}
+			var out bytes.Buffer
+			if err := DecryptHidden(&out, bytes.NewReader(f.data), tt.key); err != nil {
+				t.Fatalf("DecryptHidden: %v", err)
+			}
+			if !bytes.Equal(out.Bytes(), hidden) {
+				t.Fatalf("decrypted %d bytes, want the %d hidden", out.Len(), len(hidden))
+			}
+
+			// Other keys find nothing, not even the outer one
+			for _, k := range []Key{{Password: "password"}, {Password: "wrong", Keyfiles: tt.key.Keyfiles}} {
+				if err := DecryptHidden(&bytes.Buffer{}, bytes.NewReader(f.data), k); err != ErrIncorrectPassword {
+					t.Errorf("%q: got %v, want ErrIncorrectPassword", k.Password, err)
+				}
+			}
+
+			// The hidden volume survives rekeying the outer one
+			if err := Rekey(f, &Options{Password: "password"}, &Options{Password: "new"}); err != nil {
+				t.Fatalf("Rekey: %v", err)
+			}
+			if err := DecryptHidden(&bytes.Buffer{}, bytes.NewReader(f.data), tt.key); err != nil {
+				t.Errorf("after Rekey: %v", err)
+			}
+		})
+	}
+}
+
+func TestHiddenDenied(t *testing.T) {
+	key := Key{Password: "hidden"}
+	withHidden := func(opts *Options) {
+		opts.Hidden = &Hidden{Key: key, Data: bytes.NewReader(randomBytes(1000)), Size: 1000}
+	}
+
+	tests := []struct {
+		name   string
+		opts   Options
+		change func(o *Options)
+		damage func(v []byte)
+		err    error
+	}{
+		{"no padding", Options{}, nil, nil, ErrIncorrectPassword},
+		{"only padding", Options{Padding: 5000}, nil, nil, ErrIncorrectPassword},
+		{"tiny padding", Options{Padding: 10}, nil, nil, ErrIncorrectPassword},
+		{"damaged header", Options{Padding: 5000}, withHidden, func(v []byte) { v[len(v)-64-50] ^= 1 }, ErrIncorrectPassword},
+		{"damaged data", Options{Padding: 5000}, withHidden, func(v []byte) { v[len(v)-64-hiddenHeaderSize-10] ^= 1 }, ErrModified},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			opts.Password = "password"
+			opts.Argon2 = &testArgon2
+			if tt.change != nil {
+				tt.change(&opts)
+			}
+			f := encrypt(t, randomBytes(1000), &opts)
+			if tt.damage != nil {
+				tt.damage(f.data)
+			}
+			if err := DecryptHidden(&bytes.Buffer{}, bytes.NewReader(f.data), key); err != tt.err {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+
+	f := &memFile{data: encryptV1(t, randomBytes(1000), "password", v1Header("", false, false))}
+	if err := DecryptHidden(&bytes.Buffer{}, bytes.NewReader(f.data), key); err != ErrIncorrectPassword {
+		t.Errorf("before v2: got %v, want ErrIncorrectPassword", err)
+	}
+}
@@ -0,0 +1,35 @@
+package volume
+
+import (
+	"encoding/binary"
+	"os"
+	"time"
+)
+
+// Metadata about the original file, which is encrypted in the header so
+// the name of a volume doesn't need to give it away
+type Metadata struct {
+	Name    string      // Base name of the file
+	Mode    os.FileMode // Permission bits
+	ModTime time.Time
+}
+
+// Encode the metadata as the mode (4 bytes), the modification time in
+// nanoseconds since the Unix epoch (8 bytes), and the name
+func (m *Metadata) encode() []byte {
+	data := make([]byte, 12)
+	binary.BigEndian.PutUint32(data[:4], uint32(m.Mode.Perm()))
+	binary.BigEndian.PutUint64(data[4:12], uint64(m.ModTime.UnixNano()))
+	return append(data, m.Name...)
+}
+
+func decodeMetadata(data []byte) (*Metadata, error) {
+	if len(data) < 12 {
+		return nil, ErrHeaderDamaged
+	}
+	return &Metadata{
+		Name:    string(data[12:]),
+		Mode:    os.FileMode(binary.BigEndian.Uint32(data[:4])).Perm(),
+		ModTime: time.Unix(0, int64(binary.BigEndian.Uint64(data[4:12]))),
+	}, nil
+}
@@ -0,0 +1,349 @@
+package volume
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/HACKERALERT/crypto/sha3"
+	"github.com/HACKERALERT/infectious"
+)
+
+// A parity file holds recovery data for a volume that is kept apart from
+// it, like on another disk. The volume is split into blocks, and the blocks
+// are spread over stripes so that block i is in stripe i%stripes. Each
+// stripe of up to 128 data blocks gets its own parity blocks, so a damaged
+// or missing run of blocks only takes a few blocks from each stripe, and
+// any region up to the redundancy can be rebuilt.
+//
+// The parity file starts with a 64-byte header encoded with rs64 (192 bytes)
+// that records the layout and the SHA3-256 of the volume's header tag, so a
+// parity file made before a rekey isn't used. Each stripe follows with the
+// SHA3-256 of its data and parity blocks, each encoded with rs32 (96 bytes),
+// and then its parity blocks.
+const (
+	parityMagic  = "Picocrypt parity"
+	parityBlock  = 64 << 10 // Size of the blocks that are checked and rebuilt
+	parityStripe = 128      // Most data blocks in a stripe
+)
+
+// Errors for parity files
+var (
+	// ErrNotParity is returned for a file that isn't a parity file or whose
+	// header can't be read
+	ErrNotParity = errors.New("volume: not a parity file")
+
+	// ErrInvalidRedundancy is returned for a redundancy outside 1 to 100 percent
+	ErrInvalidRedundancy = errors.New("volume: redundancy must be 1 to 100 percent")
+
+	// ErrStaleParity is returned when the header of the volume was changed,
+	// like by Rekey, after the parity was made. Repairing would bring back
+	// the old header and its key slots.
+	ErrStaleParity = errors.New("volume: the header has changed since the parity was made")
+)
+
+// Layout of a parity file
+type parityFile struct {
+	block   int   // Size of a block
+	data    int   // Data blocks in each stripe
+	parity  int   // Parity blocks in each stripe
+	size    int64 // Size of the protected file
+	blocks  int64 // Data blocks in the protected file
+	stripes int64
+	header  []byte // SHA3-256 of the volume's header tag, nil if unknown
+	rs      *infectious.FEC
+}
+
+func newParity(block int, data int, parity int, size int64) (*parityFile, error) {
+	p := &parityFile{block: block, data: data, parity: parity, size: size}
+	p.blocks = (size + int64(block) - 1) / int64(block)
+	p.stripes = (p.blocks + int64(data) - 1) / int64(data)
+	var err error
+	p.rs, err = infectious.NewFEC(data, data+parity)
+	return p, err
+}
+
+// Offset of a stripe in the parity file
+func (p *parityFile) stripe(index int64) int64 {
+	return 192 + index*int64((p.data+p.parity)*96+p.parity*p.block)
+}
+
+// Read a data block of the protected file, padded with zeros. Only the bytes
+// within the size are read, so anything appended to the file is ignored.
+func (p *parityFile) read(r io.ReadSeeker, start int64, index int64) ([]byte, error) {
+	buf := make([]byte, p.block)
+	n := p.size - index*int64(p.block)
+	if n <= 0 {
+		return buf, nil // Past the end, so always zeros
+	}
+	if n > int64(p.block) {
+		n = int64(p.block)
+	}
+	if _, err := r.Seek(start+index*int64(p.block), io.SeekStart); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(r, buf[:n]); err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// SHA3-256 of a block
+func blockHash(data []byte) []byte {
+	tmp := sha3.New256()
+	tmp.Write(data)
+	return tmp.Sum(nil)
+}
+
+// SHA3-256 of the header tag of the volume in r, which changes whenever the
+// header does, or nil if the header can't be read
+func headerHash(r io.Reader) []byte {
+	h, err := ReadHeader(r)
+	if err != nil {
+		return nil
+	}
+	return blockHash(h.authTag)
+}
+
+// Get a header hash that was stored as zeros if it was unknown
+func storedHash(data []byte) []byte {
+	if bytes.Equal(data, make([]byte, len(data))) {
+		return nil
+	}
+	return append([]byte{}, data...)
+}
+
+// WriteParity writes a parity file to w for the file in r from its current
+// offset to the end. Up to redundancy percent (1 to 100) of the file can be
+// rebuilt from it with RepairParity, and the parity file is about as large.
+func WriteParity(w io.Writer, r io.ReadSeeker, redundancy int) error {
+	if redundancy < 1 || redundancy > 100 {
+		return ErrInvalidRedundancy
+	}
+	start, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	hash := headerHash(r)
+	end, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	// Small files have smaller stripes, with at least one parity block each
+	size := end - start
+	data := int((size + parityBlock - 1) / parityBlock)
+	if data > parityStripe {
+		data = parityStripe
+	}
+	if data == 0 {
+		data = 1
+	}
+	p, err := newParity(parityBlock, data, (data*redundancy+99)/100, size)
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, 64)
+	copy(header, parityMagic)
+	header[16] = 1
+	binary.BigEndian.PutUint32(header[17:21], uint32(p.block))
+	header[21] = byte(p.data)
+	header[22] = byte(p.parity)
+	binary.BigEndian.PutUint64(header[23:31], uint64(p.size))
+	copy(header[31:63], hash)
+	if _, err := w.Write(rsEncode(rs64, header)); err != nil {
+		return err
+	}
+
+	for s := int64(0); s < p.stripes; s++ {
+		stripe := make([]byte, 0, p.data*p.block)
+		for i := 0; i < p.data; i++ {
+			block, err := p.read(r, start, s+int64(i)*p.stripes)
+			if err != nil {
+				return err
+			}
+			stripe = append(stripe, block...)
+		}
+
+		// The hashes of every block come before the parity blocks
+		var hashes, blocks []byte
+		p.rs.Encode(stripe, func(share infectious.Share) {
+			hash := blockHash(share.Data)
+			hashes = append(hashes, rsEncode(rs32, hash)...)
+			if share.Number >= p.data {
+				blocks = append(blocks, share.Data...)
+			}
+		})
+		if _, err := w.Write(append(hashes, blocks...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RepairParity checks the file in rw from its current offset against the
+// parity file in pr and rebuilds the blocks that are damaged or missing.
+// Anything appended past the original end is cut off if rw can be truncated.
+// It returns the number of blocks that were rebuilt, and ErrDamaged if
+// some of them couldn't be. Nothing is changed and ErrStaleParity is returned
+// if the volume's header no longer matches the one the parity was made for.
+func RepairParity(rw io.ReadWriteSeeker, pr io.ReadSeeker) (int, error) {
+	start, err := rw.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	end, err := rw.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := rw.Seek(start, io.SeekStart); err != nil {
+		return 0, err
+	}
+	p, err := readParity(pr, end-start)
+	if err != nil {
+		return 0, err
+	}
+
+	// The header can only be checked if it can be read, otherwise it's
+	// rebuilt as it was when the parity was made
+	if p.header != nil {
+		if hash := headerHash(rw); hash != nil && !bytes.Equal(hash, p.header) {
+			return 0, ErrStaleParity
+		}
+	}
+
+	repaired, lost := 0, false
+	for s := int64(0); s < p.stripes; s++ {
+		// A hash that can't be decoded makes its block unusable
+		tmp := make([]byte, (p.data+p.parity)*96+p.parity*p.block)
+		if _, err := pr.Seek(p.stripe(s), io.SeekStart); err != nil {
+			return repaired, err
+		}
+		if _, err := io.ReadFull(pr, tmp); err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return repaired, err
+		}
+		hashes := make([][]byte, p.data+p.parity)
+		for i := range hashes {
+			hash, err := rsDecode(rs32, tmp[i*96:(i+1)*96], false)
+			if err == nil {
+				hashes[i] = hash
+			}
+		}
+
+		// Blocks past the end of the file are known to be zeros
+		var good []infectious.Share
+		var bad []int
+		current := make([][]byte, p.data)
+		for i := 0; i < p.data; i++ {
+			index := s + int64(i)*p.stripes
+			block, err := p.read(rw, start, index)
+			if err != nil {
+				return repaired, err
+			}
+			current[i] = block
+			if index >= p.blocks || hashes[i] != nil && bytes.Equal(blockHash(block), hashes[i]) {
+				good = append(good, infectious.Share{Number: i, Data: block})
+			} else {
+				bad = append(bad, i)
+			}
+		}
+		if len(bad) == 0 {
+			continue
+		}
+		blocks := tmp[(p.data+p.parity)*96:]
+		for i := 0; i < p.parity && len(good) < p.data; i++ {
+			block := blocks[i*p.block : (i+1)*p.block]
+			hash := hashes[p.data+i]
+			if hash != nil && bytes.Equal(blockHash(block), hash) {
+				good = append(good, infectious.Share{Number: p.data + i, Data: block})
+			}
+		}
+		if len(good) < p.data {
+			lost = true
+			continue
+		}
+
+		// Only write back blocks that match their hashes after rebuilding. A
+		// block without a hash is fine if it's rebuilt as it already was.
+		stripe, err := p.rs.Decode(nil, good)
+		if err != nil {
+			lost = true
+			continue
+		}
+		for _, i := range bad {
+			block := stripe[i*p.block : (i+1)*p.block]
+			if hashes[i] == nil && bytes.Equal(block, current[i]) {
+				continue
+			}
+			if hashes[i] == nil || !bytes.Equal(blockHash(block), hashes[i]) {
+				lost = true
+				continue
+			}
+			index := s + int64(i)*p.stripes
+			n := p.size - index*int64(p.block)
+			if n > int64(p.block) {
+				n = int64(p.block)
+			}
+			if _, err := rw.Seek(start+index*int64(p.block), io.SeekStart); err != nil {
+				return repaired, err
+			}
+			if _, err := rw.Write(block[:n]); err != nil {
+				return repaired, err
+			}
+			repaired++
+		}
+	}
+
+	// Cut off anything that was appended to the file
+	end, err = rw.Seek(0, io.SeekEnd)
+	if err != nil {
+		return repaired, err
+	}
+	if f, ok := rw.(interface{ Truncate(int64) error }); ok && end > start+p.size {
+		if err := f.Truncate(start + p.size); err != nil {
+			return repaired, err
+		}
+	}
+	if lost {
+		return repaired, ErrDamaged
+	}
+	return repaired, nil
+}
+
+// Read the header of a parity file for a volume with available bytes left.
+// The sizes come from the file, so they are checked before anything is
+// allocated for them. The parity file can't rebuild more bytes than it holds,
+// so a volume that lost more than that is reported as damaged.
+func readParity(r io.ReadSeeker, available int64) (*parityFile, error) {
+	length, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	tmp := make([]byte, 192)
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(r, tmp); err != nil {
+		return nil, ErrNotParity
+	}
+	header, err := rsDecode(rs64, tmp, false)
+	if err != nil || string(header[:16]) != parityMagic || header[16] != 1 {
+		return nil, ErrNotParity
+	}
+	block := int(binary.BigEndian.Uint32(header[17:21]))
+	data, parity := int(header[21]), int(header[22])
+	size := int64(binary.BigEndian.Uint64(header[23:31]))
+	if block != parityBlock || data < 1 || data > parityStripe || parity < 1 || data+parity > 256 || size < 0 {
+		return nil, ErrNotParity
+	}
+	if size-available > length {
+		return nil, ErrDamaged
+	}
+	p, err := newParity(block, data, parity, size)
+	if p != nil {
+		p.header = storedHash(header[31:63])
+	}
+	return p, err
+}
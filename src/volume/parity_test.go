@@ -0,0 +1,125 @@
+package volume
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRepairParity(t *testing.T) {
+	data := randomBytes(3 * MiB)
+	volume := encrypt(t, data, &Options{Password: "password", Argon2: &testArgon2}).data
+	block := parityBlock
+	var parity bytes.Buffer
+	if err := WriteParity(&parity, bytes.NewReader(volume), 10); err != nil {
+		t.Fatalf("WriteParity: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		damage   func(v []byte) []byte
+		repaired bool
+		err      error
+	}{
+		{"intact", func(v []byte) []byte { return v }, false, nil},
+		{"changed byte", func(v []byte) []byte {
+			v[MiB] ^= 1
+			return v
+		}, true, nil},
+		{"changed header", func(v []byte) []byte {
+			copy(v[100:], make([]byte, 200))
+			return v
+		}, true, nil},
+		{"zeroed blocks", func(v []byte) []byte {
+			copy(v[block:], make([]byte, 4*block))
+			return v
+		}, true, nil},
+		{"truncated", func(v []byte) []byte { return v[:len(v)-100000] }, true, nil},
+		{"appended", func(v []byte) []byte { return append(v, randomBytes(1000)...) }, false, nil},
+		{"too many blocks", func(v []byte) []byte {
+			copy(v[block:], make([]byte, 10*block))
+			return v
+		}, true, ErrDamaged},
+		{"too much truncated", func(v []byte) []byte { return v[:len(v)/2] }, true, ErrDamaged},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &memFile{data: tt.damage(append([]byte{}, volume...))}
+
+			repaired, err := RepairParity(f, bytes.NewReader(parity.Bytes()))
+			if err != tt.err {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if (repaired > 0) != tt.repaired {
+				t.Errorf("repaired %d blocks", repaired)
+			}
+			if !bytes.Equal(f.data, volume) {
+				t.Fatal("volume wasn't restored")
+			}
+			if out, err := decrypt(f, &Options{Password: "password"}); err != nil || !bytes.Equal(out, data) {
+				t.Errorf("after RepairParity: got %d bytes and %v", len(out), err)
+			}
+		})
+	}
+}
+
+func TestStaleParity(t *testing.T) {
+	f := encrypt(t, randomBytes(MiB), &Options{Password: "password", Argon2: &testArgon2})
+	var parity bytes.Buffer
+	if err := WriteParity(&parity, bytes.NewReader(f.data), 20); err != nil {
+		t.Fatal(err)
+	}
+
+	// The old parity would bring back the old key slots
+	if err := Rekey(f, &Options{Password: "password"}, &Options{Password: "new"}); err != nil {
+		t.Fatal(err)
+	}
+	f.data[len(f.data)-10] ^= 1
+	rekeyed := append([]byte{}, f.data...)
+	f.pos = 0
+	if _, err := RepairParity(f, bytes.NewReader(parity.Bytes())); err != ErrStaleParity {
+		t.Fatalf("got %v, want ErrStaleParity", err)
+	}
+	if !bytes.Equal(f.data, rekeyed) {
+		t.Error("stale parity changed the volume")
+	}
+
+	// New parity repairs it
+	f.data[len(f.data)-10] ^= 1
+	parity.Reset()
+	if err := WriteParity(&parity, bytes.NewReader(f.data), 20); err != nil {
+		t.Fatal(err)
+	}
+	f.data[len(f.data)-10] ^= 1
+	f.pos = 0
+	if repaired, err := RepairParity(f, bytes.NewReader(parity.Bytes())); err != nil || repaired != 1 {
+		t.Errorf("got %d blocks and %v", repaired, err)
+	}
+	if _, err := decrypt(f, &Options{Password: "new"}); err != nil {
+		t.Errorf("after RepairParity: %v", err)
+	}
+}
+
+func TestParityErrors(t *testing.T) {
+	f := encrypt(t, randomBytes(1000), &Options{Password: "password", Argon2: &testArgon2})
+	for _, redundancy := range []int{0, 101} {
+		if err := WriteParity(&bytes.Buffer{}, bytes.NewReader(f.data), redundancy); err != ErrInvalidRedundancy {
+			t.Errorf("redundancy %d: got %v, want ErrInvalidRedundancy", redundancy, err)
+		}
+	}
+	if _, err := RepairParity(f, bytes.NewReader(randomBytes(1000))); err != ErrNotParity {
+		t.Errorf("random parity: got %v, want ErrNotParity", err)
+	}
+
+	// A parity file with another block size isn't used
+	var parity bytes.Buffer
+	WriteParity(&parity, bytes.NewReader(f.data), 50)
+	header, _ := rsDecode(rs64, parity.Bytes()[:192], false)
+	header[17]++
+	copy(parity.Bytes(), rsEncode(rs64, header))
+	if _, err := RepairParity(f, bytes.NewReader(parity.Bytes())); err != ErrNotParity {
+		t.Errorf("other block size: got %v, want ErrNotParity", err)
+	}
+}
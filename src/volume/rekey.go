@@ -0,0 +1,107 @@
+package volume
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Errors that can occur while rekeying
+var (
+	ErrOldVersion = errors.New("volume: volumes before v2 can't be rekeyed or signed")
+	ErrNoRoom     = errors.New("volume: not enough room in the header for the new key slots")
+	ErrPadded     = errors.New("volume: the Argon2 parameters of a volume with padding can't be changed")
+)
+
+// Rekey replaces the key slots of the volume in rw so that it opens with
+// the password, keyfiles, other keys, and recipients in next instead of the
+// ones in current. Only the header is rewritten since the file key stays
+// the same. The header keeps its size, so there must be room for the new slots.
+//
+// Unless next asks for others, the first password slot keeps its Argon2
+// parameters, so a volume made for a device with little memory still opens
+// there. A hidden volume in the padding uses the parameters of the first
+// password slot, and there's no telling whether there is one. So if the
+// volume has padding and next asks for other parameters, ErrPadded is
+// returned.
+func Rekey(rw io.ReadWriteSeeker, current *Options, next *Options) error {
+	start, err := rw.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	h, err := ReadHeader(rw)
+	if err != nil {
+		return err
+	}
+	if !h.chunked() {
+		return ErrOldVersion
+	}
+
+	// Get the file key and make sure the header can be trusted
+	key, err := openSlots(h, current)
+	if err != nil {
+		return err
+	}
+	c := newCiphers(key, h)
+	if subtle.ConstantTimeCompare(c.headerTag(h), h.authTag) == 0 {
+		return ErrHeaderModified
+	}
+
+	padded, err := hasPadding(rw, start, h, c)
+	if err != nil {
+		return err
+	}
+	first := hiddenArgon2(h)[0]
+	if next.Argon2 == nil {
+		tmp := *next
+		tmp.Argon2 = &first
+		next = &tmp
+	}
+
+	// Encrypt the same file key for the new credentials
+	slots, err := newSlots(key, h, next)
+	if err != nil {
+		return err
+	}
+	if padded && hiddenArgon2(&Header{Paranoid: h.Paranoid, slots: slots})[0] != first {
+		return ErrPadded
+	}
+	// Keep the other entries, like a signature, as they are
+	entries := encodeSlots(slots)
+	readEntries(h.entries, func(kind byte, value []byte) error {
+		if kind != entryPassword && kind != entryRecipient {
+			entries = appendEntry(entries, kind, value)
+		}
+		return nil
+	})
+	if len(entries) > len(h.entries) {
+		return ErrNoRoom
+	}
+	h.slots = slots
+	h.entries = padEntries(entries, len(h.entries))
+	h.authTag = c.headerTag(h)
+
+	// Write the flags, tag, and entries back into the header
+	if err := writeHeaderTail(rw, start, h); err != nil {
+		return err
+	}
+	return writeEntriesAt(rw, start, h)
+}
+
+// Check whether anything was encrypted after the data
+func hasPadding(r io.ReadSeeker, start int64, h *Header, c *ciphers) (bool, error) {
+	sealed := findEntry(h.entries, entrySize)
+	if sealed == nil {
+		return false, nil
+	}
+	size, err := c.openEntry(entrySize, sealed)
+	if err != nil || len(size) != 8 {
+		return false, ErrHeaderModified
+	}
+	chunks, err := newChunkFile(r, start, h)
+	if err != nil {
+		return false, err
+	}
+	return chunks.total > int64(binary.BigEndian.Uint64(size)), nil
+}
@@ -0,0 +1,84 @@
+package volume
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRekey(t *testing.T) {
+	keyfile := filepath.Join(t.TempDir(), "keyfile")
+	if err := os.WriteFile(keyfile, randomBytes(100), 0600); err != nil {
+		t.Fatal(err)
+	}
+	slow := Argon2{2, 64, 1}
+	recipient := mustRecipient(t, testIdentity)
+
+	tests := []struct {
+		name    string
+		padding int
+		current Options
+		next    Options
+		open    Options // Opens the volume afterwards
+		argon2  Argon2  // Parameters of the first password slot afterwards
+		err     error
+	}{
+		{"password", 0, Options{Password: "password"}, Options{Password: "new"}, Options{Password: "new"}, slow, nil},
+		{"keyfiles", 0, Options{Password: "password"}, Options{Password: "new", Keyfiles: []string{keyfile}}, Options{Password: "new", Keyfiles: []string{keyfile}}, slow, nil},
+		{"recipient", 0, Options{Password: "password"}, Options{Password: "new", Recipients: [][]byte{recipient}}, Options{Identities: [][]byte{testIdentity}}, slow, nil},
+		{"other parameters", 0, Options{Password: "password"}, Options{Password: "new", Argon2: &testArgon2}, Options{Password: "new"}, testArgon2, nil},
+		{"padding", MiB, Options{Password: "password"}, Options{Password: "new"}, Options{Password: "new"}, slow, nil},
+		{"padding, same parameters", MiB, Options{Password: "password"}, Options{Password: "new", Argon2: &slow}, Options{Password: "new"}, slow, nil},
+		{"padding, other parameters", MiB, Options{Password: "password"}, Options{Password: "new", Argon2: &testArgon2}, Options{Password: "password"}, slow, ErrPadded},
+		{"wrong password", 0, Options{Password: "wrong"}, Options{Password: "new"}, Options{Password: "password"}, slow, ErrIncorrectPassword},
+		{"no room", 0, Options{Password: "password"}, Options{Password: "new", Keys: make([]Key, 4)}, Options{Password: "password"}, slow, ErrNoRoom},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := randomBytes(MiB + 100)
+			opts := &Options{Password: "password", Argon2: &slow, Comments: "comments", Notes: "notes", Padding: int64(tt.padding)}
+			f := encrypt(t, data, opts)
+			original := append([]byte{}, f.data...)
+
+			next := tt.next
+			if err := Rekey(f, &tt.current, &next); err != tt.err {
+				t.Fatalf("Rekey: got %v, want %v", err, tt.err)
+			}
+			if tt.err != nil && !bytes.Equal(f.data, original) {
+				t.Fatal("volume changed even though Rekey failed")
+			}
+			start := readHeader(t, f).Size()
+			if len(f.data) != len(original) || !bytes.Equal(f.data[start:], original[start:]) {
+				t.Fatal("Rekey changed more than the header")
+			}
+
+			v, err := NewReader(bytes.NewReader(f.data), &tt.open)
+			if err != nil {
+				t.Fatalf("NewReader: %v", err)
+			}
+			var out bytes.Buffer
+			if _, err := out.ReadFrom(v); err != nil {
+				t.Fatalf("Read: %v", err)
+			}
+			if !bytes.Equal(out.Bytes(), data) || v.Notes() != opts.Notes || v.Header().Comments != opts.Comments {
+				t.Fatal("rekeyed volume lost its data, notes, or comments")
+			}
+			if a := v.Header().slots[0].argon2; a != tt.argon2 {
+				t.Errorf("first password slot has %v, want %v", a, tt.argon2)
+			}
+			if tt.err == nil {
+				if _, err := decrypt(f, &Options{Password: "password", Keyfiles: tt.open.Keyfiles}); err != ErrIncorrectPassword {
+					t.Errorf("old password: got %v, want ErrIncorrectPassword", err)
+				}
+			}
+		})
+	}
+}
+
+func TestRekeyOldVersion(t *testing.T) {
+	f := &memFile{data: encryptV1(t, randomBytes(1000), "password", v1Header("", false, false))}
+	if err := Rekey(f, &Options{Password: "password"}, &Options{Password: "new"}); err != ErrOldVersion {
+		t.Errorf("got %v, want ErrOldVersion", err)
+	}
+}
@@ -0,0 +1,257 @@
+package volume
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"regexp"
+	"strconv"
+
+	"github.com/HACKERALERT/infectious"
+)
+
+// Repaired counts what Repair corrected
+type Repaired struct {
+	Header int // Reed-Solomon blocks of the header and entries
+	Data   int // Reed-Solomon blocks of the data and chunk tags
+	Lost   int // Blocks that couldn't be corrected and were left as they are
+}
+
+// Repair corrects the Reed-Solomon blocks of the volume in rw, starting at
+// its current offset, and writes the corrected blocks back so the damage
+// doesn't have to be corrected again on every decryption. Only the header
+// is encoded unless the volume was encrypted with Reed-Solomon. No password
+// is needed since only the encoded bytes are checked. ErrDamaged is returned
+// if some blocks couldn't be corrected, and ErrHeaderDamaged if the header
+// is too damaged to find the data.
+func Repair(rw io.ReadWriteSeeker) (Repaired, error) {
+	var result Repaired
+	start, err := rw.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return result, err
+	}
+	r := &repairer{rw: rw, offset: start, count: &result.Header, lost: &result.Lost}
+
+	// Check that this is a volume before changing anything
+	version, ok, err := r.peek(rs5)
+	if err != nil {
+		return result, ErrNotVolume
+	}
+	if valid, _ := regexp.Match(`^v\d\.\d{2}`, version); !valid {
+		return result, ErrNotVolume
+	}
+	h := &Header{Version: string(version)}
+	if _, _, err = r.fix(rs5); err != nil {
+		return result, err
+	}
+
+	// The length of the comments is needed to find the rest of the header
+	length, ok, err := r.fix(rs5)
+	if err != nil {
+		return result, err
+	} else if !ok {
+		return result, ErrHeaderDamaged
+	}
+	if h.chunked() {
+		for _, i := range length {
+			h.commentsLength = h.commentsLength<<8 | int(i)
+		}
+	} else {
+		h.commentsLength, _ = strconv.Atoi(string(length))
+	}
+	if h.commentsLength < 0 || h.commentsLength > MaxComments {
+		return result, ErrHeaderDamaged
+	}
+	for i := 0; i < h.commentsLength; i++ {
+		var err error
+		if h.chunked() {
+			_, _, err = r.fix(rs128)
+			i += 127
+		} else {
+			_, _, err = r.fix(rs1)
+		}
+		if err != nil {
+			return result, err
+		}
+	}
+
+	// The flags tell how the data is encoded
+	flags, ok, err := r.fix(rs5)
+	if err != nil {
+		return result, err
+	} else if !ok {
+		return result, ErrHeaderDamaged
+	}
+	h.ReedSolomon = flags[3]&1 == 1
+	h.Interleaved = flags[3]&2 != 0 && h.ReedSolomon && h.chunked()
+	h.Parity = 8
+	if h.ReedSolomon && h.chunked() {
+		h.Parity <<= flags[3] >> 2 & 3
+	}
+	for _, rs := range []*infectious.FEC{rs16, rs32, rs16, rs24, rs64, rs32, rs64} {
+		if _, _, err := r.fix(rs); err != nil {
+			return result, err
+		}
+	}
+
+	// The entries that follow the header since v2
+	if h.chunked() {
+		tmp, ok, err := r.fix(rs8)
+		if err != nil {
+			return result, err
+		}
+		size := binary.BigEndian.Uint64(tmp)
+		if !ok || size%64 != 0 || size > maxEntries {
+			return result, ErrHeaderDamaged
+		}
+		for i := uint64(0); i < size; i += 64 {
+			if _, _, err := r.fix(rs64); err != nil {
+				return result, err
+			}
+		}
+	}
+
+	if h.ReedSolomon {
+		r.count = &result.Data
+		if err := r.chunks(h); err != nil {
+			return result, err
+		}
+	}
+	if result.Lost > 0 {
+		return result, ErrDamaged
+	}
+	return result, nil
+}
+
+// repairer corrects the Reed-Solomon blocks of a volume one after another
+type repairer struct {
+	rw     io.ReadWriteSeeker
+	offset int64 // Offset of the next block
+	count  *int  // Blocks that were corrected
+	lost   *int  // Blocks that couldn't be corrected
+}
+
+// Read and decode the next block without moving past it
+func (r *repairer) peek(rs *infectious.FEC) ([]byte, bool, error) {
+	tmp := make([]byte, rs.Total())
+	if _, err := r.rw.Seek(r.offset, io.SeekStart); err != nil {
+		return nil, false, err
+	}
+	if _, err := io.ReadFull(r.rw, tmp); err != nil {
+		return nil, false, ErrHeaderDamaged
+	}
+	data, err := rsDecode(rs, tmp, false)
+	return data, err == nil, nil
+}
+
+// Decode the next block and write it back if it was corrected. Whether it
+// could be corrected is returned along with the data.
+func (r *repairer) fix(rs *infectious.FEC) ([]byte, bool, error) {
+	tmp := make([]byte, rs.Total())
+	if _, err := r.rw.Seek(r.offset, io.SeekStart); err != nil {
+		return nil, false, err
+	}
+	if _, err := io.ReadFull(r.rw, tmp); err != nil {
+		return nil, false, ErrHeaderDamaged
+	}
+	data, changed, ok := correct(rs, tmp)
+	if changed {
+		if _, err := r.rw.Seek(r.offset, io.SeekStart); err != nil {
+			return nil, false, err
+		}
+		if _, err := r.rw.Write(tmp); err != nil {
+			return nil, false, err
+		}
+	}
+	r.offset += int64(len(tmp))
+	return data, ok, nil
+}
+
+// Correct the encoded chunks of data and their tags
+func (r *repairer) chunks(h *Header) error {
+	size := MiB / 128 * (128 + h.Parity)
+	tag := 0
+	if h.chunked() {
+		tag = 192
+	}
+	src := make([]byte, size+tag)
+	for {
+		if _, err := r.rw.Seek(r.offset, io.SeekStart); err != nil {
+			return err
+		}
+		read, err := io.ReadFull(r.rw, src)
+		if err == io.EOF {
+			return nil
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		chunk := src[:read]
+
+		// A truncated chunk is left as it is
+		data := chunk
+		if len(chunk) >= tag {
+			data = chunk[:len(chunk)-tag]
+		}
+		if len(chunk) < tag || len(data)%(128+h.Parity) != 0 {
+			*r.lost++
+			return nil
+		}
+
+		changed := false
+		if tag > 0 {
+			_, fixed, ok := correct(rs64, chunk[len(data):])
+			r.tally(fixed, ok)
+			changed = changed || fixed
+		}
+		blocks := data
+		if h.Interleaved {
+			blocks = deinterleave(data, 128+h.Parity)
+		}
+		for i := 0; i < len(blocks); i += 128 + h.Parity {
+			_, fixed, ok := correct(dataFEC[h.Parity], blocks[i:i+128+h.Parity])
+			r.tally(fixed, ok)
+			changed = changed || fixed
+		}
+		if h.Interleaved {
+			copy(data, interleave(blocks, 128+h.Parity))
+		}
+
+		if changed {
+			if _, err := r.rw.Seek(r.offset, io.SeekStart); err != nil {
+				return err
+			}
+			if _, err := r.rw.Write(chunk); err != nil {
+				return err
+			}
+		}
+		r.offset += int64(read)
+		if read < len(src) {
+			return nil
+		}
+	}
+}
+
+// Count a block as corrected or lost
+func (r *repairer) tally(fixed bool, ok bool) {
+	if fixed {
+		*r.count++
+	}
+	if !ok {
+		*r.lost++
+	}
+}
+
+// Correct a Reed-Solomon block in place, returning its data, whether it was
+// changed, and whether it could be corrected at all
+func correct(rs *infectious.FEC, block []byte) ([]byte, bool, bool) {
+	data, err := rsDecode(rs, block, false)
+	if err != nil {
+		return data, false, false
+	}
+	encoded := rsEncode(rs, data)
+	if bytes.Equal(encoded, block) {
+		return data, false, true
+	}
+	copy(block, encoded)
+	return data, true, true
+}
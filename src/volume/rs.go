@@ -0,0 +1,103 @@
+package volume
+
+import (
+	"bytes"
+
+	"github.com/HACKERALERT/infectious"
+)
+
+// Reed-Solomon encoders
+var rs1, _ = infectious.NewFEC(1, 3)
+var rs5, _ = infectious.NewFEC(5, 15)
+var rs8, _ = infectious.NewFEC(8, 24)
+var rs16, _ = infectious.NewFEC(16, 48)
+var rs24, _ = infectious.NewFEC(24, 72)
+var rs32, _ = infectious.NewFEC(32, 96)
+var rs64, _ = infectious.NewFEC(64, 192)
+var rs128, _ = infectious.NewFEC(128, 136)
+var rs128x16, _ = infectious.NewFEC(128, 144)
+var rs128x32, _ = infectious.NewFEC(128, 160)
+var rs128x64, _ = infectious.NewFEC(128, 192)
+
+// Reed-Solomon encoders for the data by the number of parity bytes in each
+// 128-byte block, which can correct half as many damaged bytes
+var dataFEC = map[int]*infectious.FEC{8: rs128, 16: rs128x16, 32: rs128x32, 64: rs128x64}
+
+// Reed-Solomon encoder
+func rsEncode(rs *infectious.FEC, data []byte) []byte {
+	res := make([]byte, rs.Total())
+	rs.Encode(data, func(s infectious.Share) {
+		res[s.Number] = s.Data[0]
+	})
+	return res
+}
+
+// Reed-Solomon decoder
+func rsDecode(rs *infectious.FEC, data []byte, fastDecode bool) ([]byte, error) {
+	// If fast decode, just return the first 128 bytes
+	if rs.Required() == 128 && fastDecode {
+		return data[:128], nil
+	}
+
+	tmp := make([]infectious.Share, rs.Total())
+	for i := 0; i < rs.Total(); i++ {
+		tmp[i].Number = i
+		tmp[i].Data = append(tmp[i].Data, data[i])
+	}
+	res, err := rs.Decode(nil, tmp)
+
+	// Force decode the data but return the error as well
+	if err != nil {
+		return data[:rs.Required()], err
+	}
+
+	// No issues, return the decoded data
+	return res, nil
+}
+
+// Spread the codewords of an encoded chunk across the whole chunk, so byte
+// j of codeword i is stored at j*n+i where n is the number of codewords.
+// Damage to a run of bytes, like a bad sector, then only hits a few bytes
+// of each codeword instead of many bytes of a few codewords.
+func interleave(src []byte, size int) []byte {
+	n := len(src) / size
+	dst := make([]byte, len(src))
+	for i := 0; i < n; i++ {
+		for j := 0; j < size; j++ {
+			dst[j*n+i] = src[i*size+j]
+		}
+	}
+	return dst
+}
+
+// Gather the codewords of an interleaved chunk back together. A truncated
+// chunk is left as is, since decoding it fails either way.
+func deinterleave(src []byte, size int) []byte {
+	if len(src)%size != 0 {
+		return src
+	}
+	n := len(src) / size
+	dst := make([]byte, len(src))
+	for i := 0; i < n; i++ {
+		for j := 0; j < size; j++ {
+			dst[i*size+j] = src[j*n+i]
+		}
+	}
+	return dst
+}
+
+// PKCS#7 pad (for use with Reed-Solomon)
+func pad(data []byte) []byte {
+	padLen := 128 - len(data)%128
+	padding := bytes.Repeat([]byte{byte(padLen)}, padLen)
+	return append(data, padding...)
+}
+
+// PKCS#7 unpad
+func unpad(data []byte) []byte {
+	padLen := int(data[127])
+	if padLen > 128 { // Damaged padding, keep the whole block
+		return data[:128]
+	}
+	return data[:128-padLen]
+}
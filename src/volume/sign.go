@@ -0,0 +1,158 @@
+package volume
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+
+	"github.com/HACKERALERT/crypto/sha3"
+)
+
+// Errors that can occur while verifying a signature
+var (
+	ErrNotSigned    = errors.New("volume: the volume isn't signed")
+	ErrBadSignature = errors.New("volume: the signature doesn't match the volume or the public key")
+)
+
+// NewSigningKey generates a random Ed25519 private key (a 32-byte seed) for
+// signing volumes
+func NewSigningKey() []byte {
+	key := make([]byte, ed25519.SeedSize)
+	rand.Read(key)
+	return key
+}
+
+// SigningPublicKey returns the Ed25519 public key that verifies signatures
+// made with a signing key
+func SigningPublicKey(key []byte) ([]byte, error) {
+	if len(key) != ed25519.SeedSize {
+		return nil, errors.New("volume: signing keys must be 32 bytes")
+	}
+	return ed25519.NewKeyFromSeed(key).Public().(ed25519.PublicKey), nil
+}
+
+// A signature is the signer's public key followed by the Ed25519 signature
+const signatureSize = ed25519.PublicKeySize + ed25519.SignatureSize
+
+// signer hashes everything a signature covers as a volume is written or read
+type signer struct {
+	chunks hash.Hash
+}
+
+func newSigner() *signer {
+	return &signer{chunks: sha3.New512()}
+}
+
+// Add an encrypted chunk and its tag, before Reed-Solomon encoding
+func (s *signer) chunk(data []byte, tag []byte) {
+	s.chunks.Write(data)
+	s.chunks.Write(tag)
+}
+
+// Get the message that is signed, which covers the header and the chunks.
+// Key slots and the keyfile flags are left out so a signature survives
+// rekeying, and so is the signature itself.
+func (s *signer) message(h *Header) []byte {
+	header := sha3.New512()
+	length := make([]byte, 8)
+	binary.BigEndian.PutUint64(length, uint64(len(h.Comments)))
+	flags := headerFlags(h)
+	flags[1], flags[2] = 0, 0
+	for _, data := range [][]byte{
+		[]byte(h.Version),
+		length,
+		[]byte(h.Comments),
+		flags,
+		h.hkdfSalt,
+		h.serpentIV,
+		h.nonce,
+	} {
+		header.Write(data)
+	}
+	readEntries(h.entries, func(kind byte, value []byte) error {
+		if kind != entryPassword && kind != entryRecipient && kind != entrySignature {
+			header.Write(appendEntry(nil, kind, value))
+		}
+		return nil
+	})
+
+	message := []byte("Picocrypt signature")
+	message = header.Sum(message)
+	return s.chunks.Sum(message)
+}
+
+// Sign the message and return the signature with the public key
+func (s *signer) sign(h *Header, key []byte) []byte {
+	private := ed25519.NewKeyFromSeed(key)
+	signature := append([]byte{}, private.Public().(ed25519.PublicKey)...)
+	return append(signature, ed25519.Sign(private, s.message(h))...)
+}
+
+// Sign reads a whole volume from r and returns a detached signature made
+// with an Ed25519 signing key. No password is needed, only the contents of
+// the volume are signed.
+func Sign(r io.Reader, key []byte) ([]byte, error) {
+	if len(key) != ed25519.SeedSize {
+		return nil, errors.New("volume: signing keys must be 32 bytes")
+	}
+	h, s, err := readSigned(r)
+	if err != nil {
+		return nil, err
+	}
+	return s.sign(h, key), nil
+}
+
+// Verify reads a whole volume from r and checks that it was signed with the
+// private key of the trusted Ed25519 public key. If signature is nil, the
+// signature embedded in the volume is used. No password is needed.
+func Verify(r io.Reader, public []byte, signature []byte) error {
+	h, s, err := readSigned(r)
+	if err != nil {
+		return err
+	}
+	if signature == nil {
+		if signature = findEntry(h.entries, entrySignature); signature == nil {
+			return ErrNotSigned
+		}
+	}
+	if len(signature) != signatureSize || len(public) != ed25519.PublicKeySize {
+		return ErrBadSignature
+	}
+	if !bytes.Equal(signature[:ed25519.PublicKeySize], public) {
+		return ErrBadSignature
+	}
+	if !ed25519.Verify(public, s.message(h), signature[ed25519.PublicKeySize:]) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// Read the header and hash every chunk of a volume
+func readSigned(r io.Reader) (*Header, *signer, error) {
+	h, err := ReadHeader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !h.chunked() {
+		return nil, nil, ErrOldVersion
+	}
+
+	s := newSigner()
+	chunks := newChunkReader(r, h, false)
+	for {
+		data, tag, last, err := chunks.next()
+		if err == io.EOF || err == errTruncated {
+			return h, s, nil
+		} else if err != nil {
+			return nil, nil, err
+		}
+		s.chunk(data, tag)
+		if last {
+			return h, s, nil
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package volume
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSign(t *testing.T) {
+	key := NewSigningKey()
+	public, err := SigningPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := SigningPublicKey(NewSigningKey())
+
+	tests := []struct {
+		name string
+		opts Options
+	}{
+		{"embedded", Options{}},
+		{"detached", Options{Detached: true}},
+		{"reed-solomon", Options{ReedSolomon: true}},
+		{"padding", Options{Padding: 5000}},
+		{"comments and tags", Options{Comments: "comments", Tags: []Tag{{TagOwner, "me"}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			opts.Password = "password"
+			opts.Argon2 = &testArgon2
+			opts.Signer = key
+			f := &memFile{}
+			v, err := NewWriter(f, &opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			v.Write(randomBytes(MiB + 100))
+			if err := v.Close(); err != nil {
+				t.Fatal(err)
+			}
+			f.pos = 0
+
+			// Without the embedded signature, only the detached one verifies
+			signature := v.Signature()
+			if opts.Detached {
+				if err := Verify(bytes.NewReader(f.data), public, nil); err != ErrNotSigned {
+					t.Errorf("detached volume: got %v, want ErrNotSigned", err)
+				}
+			} else if err := Verify(bytes.NewReader(f.data), public, nil); err != nil {
+				t.Errorf("embedded signature: %v", err)
+			}
+			if err := Verify(bytes.NewReader(f.data), public, signature); err != nil {
+				t.Errorf("signature from Writer: %v", err)
+			}
+			if signed := readHeader(t, f).Signed(); signed == opts.Detached {
+				t.Errorf("Signed = %v", signed)
+			}
+
+			// Sign makes the same signature from the finished volume
+			detached, err := Sign(bytes.NewReader(f.data), key)
+			if err != nil {
+				t.Fatalf("Sign: %v", err)
+			}
+			if err := Verify(bytes.NewReader(f.data), public, detached); err != nil {
+				t.Errorf("signature from Sign: %v", err)
+			}
+			if err := Verify(bytes.NewReader(f.data), other, signature); err != ErrBadSignature {
+				t.Errorf("other public key: got %v, want ErrBadSignature", err)
+			}
+
+			// Rekeying keeps the signature valid
+			if err := Rekey(f, &Options{Password: "password"}, &Options{Password: "new"}); err != nil {
+				t.Fatalf("Rekey: %v", err)
+			}
+			if err := Verify(bytes.NewReader(f.data), public, signature); err != nil {
+				t.Errorf("after Rekey: %v", err)
+			}
+			if err := Verify(bytes.NewReader(f.data), public, nil); err != nil && !opts.Detached {
+				t.Errorf("embedded signature after Rekey: %v", err)
+			}
+
+			// But not changing the data or the comments
+			changed := rewriteHeader(t, f, func(h *Header) { h.Paranoid = true })
+			if err := Verify(bytes.NewReader(changed.data), public, signature); err != ErrBadSignature {
+				t.Errorf("changed header: got %v, want ErrBadSignature", err)
+			}
+			if !opts.ReedSolomon { // Which would correct a changed byte
+				tampered := append([]byte{}, f.data...)
+				tampered[readHeader(t, f).Size()+10] ^= 1
+				if err := Verify(bytes.NewReader(tampered), public, signature); err != ErrBadSignature {
+					t.Errorf("changed data: got %v, want ErrBadSignature", err)
+				}
+			}
+		})
+	}
+}
+
+func TestSignErrors(t *testing.T) {
+	key := NewSigningKey()
+	public, _ := SigningPublicKey(key)
+	f := encrypt(t, randomBytes(1000), &Options{Password: "password", Argon2: &testArgon2})
+	if err := Verify(bytes.NewReader(f.data), public, nil); err != ErrNotSigned {
+		t.Errorf("unsigned: got %v, want ErrNotSigned", err)
+	}
+	if _, err := Sign(bytes.NewReader(f.data), key[:16]); err == nil {
+		t.Error("signed with a short key")
+	}
+	if _, err := NewWriter(&memFile{}, &Options{Password: "password", Signer: key[:16]}); err == nil {
+		t.Error("NewWriter accepted a short signing key")
+	}
+	v1 := encryptV1(t, randomBytes(1000), "password", v1Header("", false, false))
+	if _, err := Sign(bytes.NewReader(v1), key); err != ErrOldVersion {
+		t.Errorf("before v2: got %v, want ErrOldVersion", err)
+	}
+}
@@ -0,0 +1,354 @@
+package volume
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+
+	"github.com/HACKERALERT/crypto/chacha20poly1305"
+	"github.com/HACKERALERT/crypto/curve25519"
+	"github.com/HACKERALERT/crypto/hkdf"
+	"github.com/HACKERALERT/crypto/sha3"
+)
+
+// Types of the entries stored after the header since v2
+const (
+	entryEnd       = 0 // Marks the end of the entries, the rest is padding
+	entryPassword  = 1 // Key slot opened with the password and keyfiles
+	entryRecipient = 2 // Key slot opened with an X25519 identity
+	entrySignature = 3 // Ed25519 public key and signature of the volume
+	entrySize      = 4 // Encrypted size of the data, anything after it is padding
+	entryMetadata  = 5 // Encrypted name, mode, and modification time of the file
+	entryNotes     = 6 // Encrypted comments
+	entryTag       = 7 // Key and value of a tag
+)
+
+// A key slot holds the file key encrypted with XChaCha20-Poly1305 under a key
+// derived from either the password and keyfiles or an X25519 key exchange
+type slot struct {
+	kind        byte
+	keyfiles    bool   // Keyfiles are required to open the slot
+	ordered     bool   // Order of keyfiles matters
+	salt        []byte // Argon2 salt (16 bytes) or ephemeral public key (32 bytes)
+	argon2      Argon2 // Argon2id parameters of a password slot
+	nonce       []byte // 24-byte XChaCha20-Poly1305 nonce
+	keyHash     []byte // SHA3-512 of the password key
+	keyfileHash []byte // SHA3-256 of the keyfile key
+	wrapped     []byte // 48-byte encrypted file key
+}
+
+// NewIdentity generates a random X25519 private key for receiving volumes
+func NewIdentity() []byte {
+	identity := make([]byte, 32)
+	rand.Read(identity)
+	return identity
+}
+
+// Recipient returns the X25519 public key of an identity, which is what
+// volumes are encrypted to
+func Recipient(identity []byte) ([]byte, error) {
+	if len(identity) != 32 {
+		return nil, errors.New("volume: identities must be 32 bytes")
+	}
+	return curve25519.X25519(identity, curve25519.Basepoint)
+}
+
+// Make the key slots that can open the file key
+func newSlots(key []byte, h *Header, opts *Options) ([]*slot, error) {
+	var slots []*slot
+	keys := opts.Keys
+	if passwordSlot(opts) {
+		keys = append([]Key{{opts.Password, opts.Keyfiles, opts.KeyfileOrdered}}, keys...)
+	}
+	a, err := argon2Params(opts.Argon2, h.Paranoid)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) > MaxPasswordSlots {
+		return nil, ErrTooManyPasswords
+	}
+	if uint64(len(keys))*a.work() > MaxArgon2Work {
+		return nil, ErrInvalidArgon2
+	}
+	for _, k := range keys {
+		s, err := newPasswordSlot(k, key, a)
+		if err != nil {
+			return nil, err
+		}
+		slots = append(slots, s)
+	}
+
+	// Keyfiles are only marked as required in the header if every slot needs them
+	h.Keyfiles = len(keys) > 0
+	h.KeyfileOrdered = false
+	for _, k := range keys {
+		h.Keyfiles = h.Keyfiles && len(k.Keyfiles) > 0
+		h.KeyfileOrdered = h.KeyfileOrdered || k.KeyfileOrdered
+	}
+	h.KeyfileOrdered = h.Keyfiles && h.KeyfileOrdered
+
+	for _, recipient := range opts.Recipients {
+		// Use a new ephemeral key for each recipient
+		ephemeral := NewIdentity()
+		public, err := Recipient(ephemeral)
+		if err != nil {
+			return nil, err
+		}
+		kek, err := recipientKey(ephemeral, recipient, public, recipient)
+		if err != nil {
+			return nil, err
+		}
+		s := &slot{kind: entryRecipient, salt: public}
+		s.nonce, s.wrapped = wrapKey(kek, key)
+		slots = append(slots, s)
+	}
+	return slots, nil
+}
+
+// Encrypt the file key under a password and keyfiles
+func newPasswordSlot(k Key, key []byte, a Argon2) (*slot, error) {
+	s := &slot{
+		kind:     entryPassword,
+		keyfiles: len(k.Keyfiles) > 0,
+		ordered:  k.KeyfileOrdered,
+		salt:     make([]byte, 16),
+		argon2:   a,
+	}
+	rand.Read(s.salt)
+	kek, keyHash, keyfileHash, err := passwordKey(k, s.salt, a, s.keyfiles)
+	if err != nil {
+		return nil, err
+	}
+	s.keyHash, s.keyfileHash = keyHash, keyfileHash
+	s.nonce, s.wrapped = wrapKey(kek, key)
+	return s, nil
+}
+
+// A slot for the password is left out if only recipients or other keys are used
+func passwordSlot(opts *Options) bool {
+	return opts.Password != "" || len(opts.Keyfiles) > 0 || len(opts.Recipients) == 0 && len(opts.Keys) == 0
+}
+
+// Get the file key by trying the identities and then the password on each
+// slot. The errors match those of older volumes where possible.
+func openSlots(h *Header, opts *Options) ([]byte, error) {
+	var passwords []*slot
+	for _, s := range h.slots {
+		if s.kind == entryPassword {
+			passwords = append(passwords, s)
+			continue
+		}
+		for _, identity := range opts.Identities {
+			recipient, err := Recipient(identity)
+			if err != nil {
+				return nil, err
+			}
+			kek, err := recipientKey(identity, s.salt, s.salt, recipient)
+			if err != nil {
+				continue
+			}
+			if key, err := unwrapKey(kek, s.nonce, s.wrapped); err == nil {
+				return key, nil
+			}
+		}
+	}
+
+	// Don't spend time on the password if only identities were given
+	if len(passwords) == 0 || len(opts.Identities) > 0 && opts.Password == "" && len(opts.Keyfiles) == 0 {
+		return nil, ErrIncorrectIdentity
+	}
+	required := true
+	for _, s := range passwords {
+		required = required && s.keyfiles
+	}
+	if required && len(opts.Keyfiles) == 0 {
+		return nil, ErrKeyfilesRequired
+	}
+
+	for _, s := range passwords {
+		k := Key{opts.Password, opts.Keyfiles, s.ordered}
+		kek, keyHash, keyfileHash, err := passwordKey(k, s.salt, s.argon2, s.keyfiles && len(k.Keyfiles) > 0)
+		if err != nil {
+			return nil, err
+		}
+		if subtle.ConstantTimeCompare(keyHash, s.keyHash) != 1 {
+			continue
+		}
+		if s.keyfiles && len(opts.Keyfiles) == 0 {
+			return nil, ErrKeyfilesRequired
+		}
+		if s.keyfiles && subtle.ConstantTimeCompare(keyfileHash, s.keyfileHash) != 1 {
+			return nil, ErrIncorrectKeyfiles
+		}
+
+		// The hashes match, so the slot itself must have been changed
+		key, err := unwrapKey(kek, s.nonce, s.wrapped)
+		if err != nil {
+			return nil, ErrHeaderModified
+		}
+		return key, nil
+	}
+	return nil, ErrIncorrectPassword
+}
+
+// Derive the key for a recipient's slot from an X25519 key exchange
+func recipientKey(private []byte, public []byte, ephemeral []byte, recipient []byte) ([]byte, error) {
+	shared, err := curve25519.X25519(private, public)
+	if err != nil {
+		return nil, err
+	}
+
+	// Bind the key to both public keys with HKDF-SHA3
+	kek := make([]byte, 32)
+	salt := append(append([]byte{}, ephemeral...), recipient...)
+	hkdf.New(sha3.New256, shared, salt, []byte("Picocrypt X25519")).Read(kek)
+	return kek, nil
+}
+
+// Encrypt the file key with XChaCha20-Poly1305
+func wrapKey(kek []byte, key []byte) ([]byte, []byte) {
+	aead, _ := chacha20poly1305.NewX(kek)
+	nonce := make([]byte, 24)
+	rand.Read(nonce)
+	return nonce, aead.Seal(nil, nonce, key, nil)
+}
+
+// Decrypt the file key, failing if it doesn't belong to kek
+func unwrapKey(kek []byte, nonce []byte, wrapped []byte) ([]byte, error) {
+	aead, _ := chacha20poly1305.NewX(kek)
+	return aead.Open(nil, nonce, wrapped, nil)
+}
+
+// Encode the key slots into entries
+func encodeSlots(slots []*slot) []byte {
+	var data []byte
+	for _, s := range slots {
+		var value []byte
+		if s.kind == entryPassword {
+			var flags byte
+			if s.keyfiles {
+				flags |= 1
+			}
+			if s.ordered {
+				flags |= 2
+			}
+			params := make([]byte, 9)
+			binary.BigEndian.PutUint32(params[:4], s.argon2.Time)
+			binary.BigEndian.PutUint32(params[4:8], s.argon2.Memory)
+			params[8] = s.argon2.Threads
+			value = append(value, flags)
+			value = append(value, s.salt...)
+			value = append(value, params...)
+			value = append(value, s.nonce...)
+			value = append(value, s.keyHash...)
+			value = append(value, s.keyfileHash...)
+		} else {
+			value = append(value, s.salt...)
+			value = append(value, s.nonce...)
+		}
+		value = append(value, s.wrapped...)
+		data = appendEntry(data, s.kind, value)
+	}
+	return data
+}
+
+// Decode the key slots from entries, skipping other types of entries. Each
+// password slot is tried in turn, so a header with more of them or more work
+// than a volume could be made with is treated as damaged.
+func decodeSlots(data []byte) ([]*slot, error) {
+	var slots []*slot
+	var passwords int
+	var work uint64
+	err := readEntries(data, func(kind byte, value []byte) error {
+		var s *slot
+		switch kind {
+		case entryPassword:
+			if len(value) != 1+16+9+24+64+32+48 {
+				return ErrHeaderDamaged
+			}
+			s = &slot{
+				kind:     kind,
+				keyfiles: value[0]&1 != 0,
+				ordered:  value[0]&2 != 0,
+				salt:     value[1:17],
+				argon2: Argon2{
+					Time:    binary.BigEndian.Uint32(value[17:21]),
+					Memory:  binary.BigEndian.Uint32(value[21:25]),
+					Threads: value[25],
+				},
+				nonce:       value[26:50],
+				keyHash:     value[50:114],
+				keyfileHash: value[114:146],
+				wrapped:     value[146:],
+			}
+			if !s.argon2.Valid() {
+				return ErrHeaderDamaged
+			}
+			passwords++
+			work += s.argon2.work()
+			if passwords > MaxPasswordSlots || work > MaxArgon2Work {
+				return ErrHeaderDamaged
+			}
+		case entryRecipient:
+			if len(value) != 32+24+48 {
+				return ErrHeaderDamaged
+			}
+			s = &slot{
+				kind:    kind,
+				salt:    value[:32],
+				nonce:   value[32:56],
+				wrapped: value[56:],
+			}
+		default:
+			return nil
+		}
+		slots = append(slots, s)
+		return nil
+	})
+	return slots, err
+}
+
+// Add an entry (type, 4-byte length, and value) to data
+func appendEntry(data []byte, kind byte, value []byte) []byte {
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(value)))
+	data = append(data, kind)
+	data = append(data, length...)
+	return append(data, value...)
+}
+
+// Get the value of the first entry of a type, or nil if there is none
+func findEntry(data []byte, kind byte) []byte {
+	var found []byte
+	readEntries(data, func(k byte, value []byte) error {
+		if k == kind && found == nil {
+			found = value
+		}
+		return nil
+	})
+	return found
+}
+
+// Fill in the value of a placeholder entry of the same size
+func setEntry(data []byte, kind byte, value []byte) {
+	copy(findEntry(data, kind), value)
+}
+
+// Call fn with each entry in data until the end of the entries
+func readEntries(data []byte, fn func(kind byte, value []byte) error) error {
+	for len(data) > 0 && data[0] != entryEnd {
+		if len(data) < 5 {
+			return ErrHeaderDamaged
+		}
+		length := binary.BigEndian.Uint32(data[1:5])
+		if uint64(length) > uint64(len(data)-5) {
+			return ErrHeaderDamaged
+		}
+		if err := fn(data[0], data[5:5+length]); err != nil {
+			return err
+		}
+		data = data[5+length:]
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package volume
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRecipient(t *testing.T) {
+	f := encrypt(t, []byte("data"), &Options{Recipients: [][]byte{mustRecipient(t, testIdentity)}})
+	out, err := decrypt(f, &Options{Identities: [][]byte{testIdentity}})
+	if err != nil || string(out) != "data" {
+		t.Fatalf("got %q, %v", out, err)
+	}
+	if passwords, recipients := readHeader(t, f).Slots(); passwords != 0 || recipients != 1 {
+		t.Errorf("Slots = %d, %d, want 0, 1", passwords, recipients)
+	}
+}
+
+// Password slots with the given parameters, as a crafted header could have
+func craftSlots(count int, a Argon2) []byte {
+	var slots []*slot
+	for i := 0; i < count; i++ {
+		slots = append(slots, &slot{
+			kind:        entryPassword,
+			salt:        make([]byte, 16),
+			argon2:      a,
+			nonce:       make([]byte, 24),
+			keyHash:     make([]byte, 64),
+			keyfileHash: make([]byte, 32),
+			wrapped:     make([]byte, 48),
+		})
+	}
+	return encodeSlots(slots)
+}
+
+func TestDecodeSlots(t *testing.T) {
+	limit := Argon2{MaxArgon2Work / MaxArgon2Memory, MaxArgon2Memory, 1}
+	tests := []struct {
+		name    string
+		entries []byte
+		err     error
+	}{
+		{"most slots", craftSlots(MaxPasswordSlots, testArgon2), nil},
+		{"one slot at the limits", craftSlots(1, limit), nil},
+		{"too many slots", craftSlots(MaxPasswordSlots+1, testArgon2), ErrHeaderDamaged},
+		{"too much work", craftSlots(2, limit), ErrHeaderDamaged},
+		{"too much work for one slot", craftSlots(1, Argon2{MaxArgon2Time, MaxArgon2Memory, 1}), ErrHeaderDamaged},
+		{"invalid parameters", craftSlots(1, Argon2{MaxArgon2Time + 1, 64, 1}), ErrHeaderDamaged},
+		{"wrong length", appendEntry(nil, entryPassword, make([]byte, 10)), ErrHeaderDamaged},
+		{"other entries", appendEntry(craftSlots(1, testArgon2), entryTag, []byte("tag")), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decodeSlots(tt.entries); err != tt.err {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestSlots(t *testing.T) {
+	keys := []Key{{Password: "second"}, {Password: "third"}}
+	recipient := mustRecipient(t, testIdentity)
+	f := encrypt(t, []byte("data"), &Options{Password: "first", Keys: keys, Recipients: [][]byte{recipient}, Argon2: &testArgon2})
+	if passwords, recipients := readHeader(t, f).Slots(); passwords != 3 || recipients != 1 {
+		t.Errorf("Slots = %d, %d, want 3, 1", passwords, recipients)
+	}
+	for _, opts := range []Options{{Password: "first"}, {Password: "third"}, {Identities: [][]byte{testIdentity}}} {
+		if out, err := decrypt(f, &opts); err != nil || !bytes.Equal(out, []byte("data")) {
+			t.Errorf("%+v: got %q and %v", opts, out, err)
+		}
+	}
+
+	// Each slot could take as long as the limit allows
+	slow := Argon2{MaxArgon2Work / MaxArgon2Memory / 2, MaxArgon2Memory, 1}
+	if _, err := NewWriter(&memFile{}, &Options{Password: "password", Keys: make([]Key, 2), Argon2: &slow}); err != ErrInvalidArgon2 {
+		t.Errorf("too much work: got %v, want ErrInvalidArgon2", err)
+	}
+}
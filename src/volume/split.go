@@ -0,0 +1,770 @@
+package volume
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/HACKERALERT/crypto/sha3"
+	"github.com/HACKERALERT/infectious"
+)
+
+// SplitWriter writes a volume straight into numbered chunks (name.0, name.1,
+// ...) so it never needs to exist as a single file. It can be seeked back
+// into, which NewWriter needs to finish the header.
+type SplitWriter struct {
+	name    string
+	size    int64 // Size of each chunk
+	limit   int   // The last allowed chunk takes the rest of the data (0 for no limit)
+	f       *os.File
+	index   int   // Chunk that f refers to
+	created int   // Number of chunks created so far
+	pos     int64 // Offset in the whole volume
+	end     int64 // Size of the whole volume
+}
+
+// NewSplitWriter returns a SplitWriter that starts a new chunk every size
+// bytes. If limit is above 0, no more than limit chunks are created.
+func NewSplitWriter(name string, size int64, limit int) (*SplitWriter, error) {
+	if size <= 0 {
+		return nil, errors.New("volume: invalid chunk size")
+	}
+	s := &SplitWriter{name: name, size: size, limit: limit, index: -1}
+	if err := s.open(0); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Chunks returns the paths of the chunks that have been created
+func (s *SplitWriter) Chunks() []string {
+	var chunks []string
+	for i := 0; i < s.created; i++ {
+		chunks = append(chunks, fmt.Sprintf("%s.%d", s.name, i))
+	}
+	return chunks
+}
+
+// Switch to another chunk, creating it if it doesn't exist yet
+func (s *SplitWriter) open(index int) error {
+	if index == s.index {
+		return nil
+	}
+	if s.f != nil {
+		if err := s.f.Close(); err != nil {
+			return err
+		}
+		s.f = nil
+	}
+
+	var err error
+	path := fmt.Sprintf("%s.%d", s.name, index)
+	if index < s.created {
+		s.f, err = os.OpenFile(path, os.O_WRONLY, 0)
+	} else {
+		s.f, err = os.Create(path)
+		s.created = index + 1
+	}
+	if err != nil {
+		return err
+	}
+	s.index = index
+	return nil
+}
+
+// Write data into the current chunk, moving on to the next one when it's full
+func (s *SplitWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		index := int(s.pos / s.size)
+		if s.limit > 0 && index >= s.limit {
+			index = s.limit - 1
+		}
+		if err := s.open(index); err != nil {
+			return written, err
+		}
+
+		// Fill the chunk up to its size unless it's the last one
+		offset := s.pos - int64(index)*s.size
+		data := p
+		if index != s.limit-1 && int64(len(data)) > s.size-offset {
+			data = data[:s.size-offset]
+		}
+		if _, err := s.f.Seek(offset, io.SeekStart); err != nil {
+			return written, err
+		}
+		n, err := s.f.Write(data)
+		written += n
+		s.pos += int64(n)
+		if s.pos > s.end {
+			s.end = s.pos
+		}
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Seek sets the offset for the next Write relative to the whole volume
+func (s *SplitWriter) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += s.pos
+	case io.SeekEnd:
+		offset += s.end
+	}
+	if offset < 0 {
+		return 0, errors.New("volume: negative position")
+	}
+	s.pos = offset
+	return offset, nil
+}
+
+// Close closes the chunk that is currently open
+func (s *SplitWriter) Close() error {
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	s.index = -1
+	return err
+}
+
+// Remove closes and deletes every chunk that has been created
+func (s *SplitWriter) Remove() {
+	s.Close()
+	for _, path := range s.Chunks() {
+		os.Remove(path)
+	}
+}
+
+// SplitReader reads the chunks of a split volume (name.0, name.1, ...) as if
+// they were a single file
+type SplitReader struct {
+	name  string
+	sizes []int64 // Size of each chunk
+	f     *os.File
+	end   int64 // Offset in the whole volume where f ends
+	pos   int64 // Offset in the whole volume
+	size  int64 // Size of the whole volume
+}
+
+// NewSplitReader finds the chunks of a split volume and opens the first one.
+// ErrChunkMissing is returned if any chunk is missing, which RepairSplit may
+// be able to rebuild.
+func NewSplitReader(name string) (*SplitReader, error) {
+	s := &SplitReader{name: name}
+	for i := 0; ; i++ {
+		stat, err := os.Stat(fmt.Sprintf("%s.%d", name, i))
+		if err != nil {
+			break
+		}
+		s.sizes = append(s.sizes, stat.Size())
+		s.size += stat.Size()
+	}
+	if missingChunks(name, len(s.sizes)) {
+		return nil, ErrChunkMissing
+	}
+	if err := s.open(); err != nil {
+		if err == io.EOF {
+			err = os.ErrNotExist
+		}
+		return nil, err
+	}
+	return s, nil
+}
+
+// Check for chunks after the first gap, or fewer chunks than the parity
+// chunks were made for
+func missingChunks(name string, count int) bool {
+	prefix := filepath.Base(name) + "."
+	entries, _ := os.ReadDir(filepath.Dir(name))
+	for _, i := range entries {
+		index, err := strconv.Atoi(strings.TrimPrefix(i.Name(), prefix))
+		if strings.HasPrefix(i.Name(), prefix) && err == nil && index >= count {
+			return true
+		}
+	}
+	c, _, err := readChunkParity(name)
+	return err == nil && c.data > count
+}
+
+// Size returns the combined size of all chunks
+func (s *SplitReader) Size() int64 {
+	return s.size
+}
+
+// Open the chunk that holds the current offset
+func (s *SplitReader) open() error {
+	start := int64(0)
+	for i, size := range s.sizes {
+		if s.pos < start+size {
+			f, err := os.Open(fmt.Sprintf("%s.%d", s.name, i))
+			if err != nil {
+				return err
+			}
+			if _, err := f.Seek(s.pos-start, io.SeekStart); err != nil {
+				f.Close()
+				return err
+			}
+			s.f = f
+			s.end = start + size
+			return nil
+		}
+		start += size
+	}
+	return io.EOF
+}
+
+// Read data from the current chunk, moving on to the next one at its end
+func (s *SplitReader) Read(p []byte) (int, error) {
+	for {
+		if s.f == nil {
+			if err := s.open(); err != nil {
+				return 0, err
+			}
+		}
+		n, err := s.f.Read(p)
+		s.pos += int64(n)
+		if err != io.EOF {
+			return n, err
+		}
+
+		// A chunk that shrank since it was found can't be read past
+		s.f.Close()
+		s.f = nil
+		if s.pos < s.end {
+			return n, io.ErrUnexpectedEOF
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// Seek sets the offset for the next Read relative to the whole volume
+func (s *SplitReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += s.pos
+	case io.SeekEnd:
+		offset += s.size
+	}
+	if offset < 0 {
+		return 0, errors.New("volume: negative position")
+	}
+	if s.f != nil {
+		s.f.Close()
+		s.f = nil
+	}
+	s.pos = offset
+	return offset, nil
+}
+
+// Close closes the chunk that is currently open
+func (s *SplitReader) Close() error {
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
+
+// SplitFile reads and writes the existing chunks of a split volume as if
+// they were a single file, so a header that spans several chunks can be
+// changed in place
+type SplitFile struct {
+	r *SplitReader
+	w *SplitWriter
+}
+
+// OpenSplitFile opens the chunks of a split volume for reading and writing.
+// Every chunk but the last must have the same size, as SplitWriter makes them.
+func OpenSplitFile(name string) (*SplitFile, error) {
+	r, err := NewSplitReader(name)
+	if err != nil {
+		return nil, err
+	}
+	for _, size := range r.sizes[:len(r.sizes)-1] {
+		if size != r.sizes[0] || size == 0 {
+			r.Close()
+			return nil, errors.New("volume: the chunks don't have the same size")
+		}
+	}
+	w := &SplitWriter{
+		name:    name,
+		size:    r.sizes[0],
+		limit:   len(r.sizes),
+		index:   -1,
+		created: len(r.sizes),
+		end:     r.size,
+	}
+	return &SplitFile{r, w}, nil
+}
+
+// Read data from the chunks
+func (s *SplitFile) Read(p []byte) (int, error) {
+	return s.r.Read(p)
+}
+
+// Write data over the chunks, moving past it for the next Read
+func (s *SplitFile) Write(p []byte) (int, error) {
+	if _, err := s.w.Seek(s.r.pos, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := s.w.Write(p)
+	if _, serr := s.r.Seek(int64(n), io.SeekCurrent); err == nil {
+		err = serr
+	}
+	return n, err
+}
+
+// Seek sets the offset for the next Read or Write
+func (s *SplitFile) Seek(offset int64, whence int) (int64, error) {
+	return s.r.Seek(offset, whence)
+}
+
+// Close closes the chunks that are open
+func (s *SplitFile) Close() error {
+	err := s.w.Close()
+	if rerr := s.r.Close(); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// Parity chunks (name.p0, name.p1, ...) let a split volume be restored when
+// whole chunks are lost. Byte x of every chunk, with shorter chunks padded
+// with zeros, forms a Reed-Solomon codeword whose parity is byte x of each
+// parity chunk, so any chunks can be rebuilt as long as no more are missing
+// than there are parity chunks.
+//
+// Each parity chunk starts with a 64-byte header encoded with rs64 (192
+// bytes). Besides the counts, it keeps the SHA3-256 of the header tag
+// found in the first chunk, which tells stale parity chunks apart. Then
+// come the size (rs8) and SHA3-256 (rs32) of every data and parity chunk,
+// so any one parity chunk is enough to check the others.
+const chunksMagic = "Picocrypt chunks"
+
+// Errors for the chunks of a split volume
+var (
+	ErrChunkMissing  = errors.New("volume: a chunk of the split volume is missing")
+	ErrTooManyChunks = errors.New("volume: there can be at most 256 data and parity chunks")
+)
+
+// Layout of the parity chunks of a split volume
+type chunkParity struct {
+	data   int      // Number of data chunks
+	parity int      // Number of parity chunks
+	length int64    // Size of the parity in each parity chunk, the largest data chunk
+	sizes  []int64  // Size of every data chunk and the parity of every parity chunk
+	hashes [][]byte // SHA3-256 of the same, nil if damaged
+	tag    []byte   // SHA3-256 of the volume's header tag, nil if unknown
+}
+
+func (c *chunkParity) headerSize() int64 {
+	return 192 + int64(c.data+c.parity)*120
+}
+
+// Encode the header of parity chunk index
+func (c *chunkParity) header(index int) []byte {
+	header := make([]byte, 64)
+	copy(header, chunksMagic)
+	header[16] = 1
+	header[17] = byte(c.data)
+	header[18] = byte(c.parity)
+	header[19] = byte(index)
+	binary.BigEndian.PutUint64(header[20:28], uint64(c.length))
+	copy(header[28:60], c.tag)
+	data := rsEncode(rs64, header)
+	for i := range c.sizes {
+		size := make([]byte, 8)
+		binary.BigEndian.PutUint64(size, uint64(c.sizes[i]))
+		data = append(data, rsEncode(rs8, size)...)
+		data = append(data, rsEncode(rs32, c.hashes[i])...)
+	}
+	return data
+}
+
+// Read the headers of the parity chunks of a split volume. Sizes and hashes
+// that are damaged in one header are taken from the others.
+func readChunkParity(name string) (*chunkParity, []bool, error) {
+	var c *chunkParity
+	var found []bool
+	for i := 0; i < 256 && (c == nil || i < c.parity); i++ {
+		f, err := os.Open(fmt.Sprintf("%s.p%d", name, i))
+		if err != nil {
+			continue
+		}
+		tmp := make([]byte, 192)
+		_, err = io.ReadFull(f, tmp)
+		header, rsErr := rsDecode(rs64, tmp, false)
+		if err != nil || rsErr != nil || string(header[:16]) != chunksMagic || header[16] != 1 ||
+			header[17] == 0 || header[18] == 0 || int(header[17])+int(header[18]) > 256 {
+			f.Close()
+			continue
+		}
+		if c == nil {
+			c = &chunkParity{
+				data:   int(header[17]),
+				parity: int(header[18]),
+				length: int64(binary.BigEndian.Uint64(header[20:28])),
+				tag:    storedHash(header[28:60]),
+			}
+			c.sizes = make([]int64, c.data+c.parity)
+			c.hashes = make([][]byte, c.data+c.parity)
+			for j := range c.sizes {
+				c.sizes[j] = -1
+			}
+			found = make([]bool, c.parity)
+		}
+		if int(header[17]) != c.data || int(header[18]) != c.parity || int(header[19]) != i ||
+			int64(binary.BigEndian.Uint64(header[20:28])) != c.length {
+			f.Close()
+			continue
+		}
+		if i >= len(found) {
+			f.Close()
+			return nil, nil, ErrNotParity
+		}
+
+		tmp = make([]byte, (c.data+c.parity)*120)
+		_, err = io.ReadFull(f, tmp)
+		f.Close()
+		if err != nil {
+			continue
+		}
+		found[i] = true
+		for j := range c.sizes {
+			size, err := rsDecode(rs8, tmp[j*120:j*120+24], false)
+			if err == nil && c.sizes[j] < 0 {
+				c.sizes[j] = int64(binary.BigEndian.Uint64(size))
+			}
+			hash, err := rsDecode(rs32, tmp[j*120+24:(j+1)*120], false)
+			if err == nil && c.hashes[j] == nil {
+				c.hashes[j] = hash
+			}
+		}
+	}
+	if c == nil {
+		return nil, nil, ErrNotParity
+	}
+	return c, found, nil
+}
+
+// Hash the header tag of a split volume, reading its chunks up to the first
+// missing one, or return nil if the header can't be read
+func splitHeaderHash(name string) []byte {
+	var chunks []io.Reader
+	for i := 0; ; i++ {
+		f, err := os.Open(fmt.Sprintf("%s.%d", name, i))
+		if err != nil {
+			break
+		}
+		defer f.Close()
+		chunks = append(chunks, f)
+	}
+	return headerHash(io.MultiReader(chunks...))
+}
+
+// Hash a file, or return nil if it can't be read
+func fileHash(path string) []byte {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	tmp := sha3.New256()
+	if _, err := io.Copy(tmp, f); err != nil {
+		return nil
+	}
+	return tmp.Sum(nil)
+}
+
+// WriteSplitParity makes parity chunks for the chunks of the split volume
+// name, so that up to parity chunks can be lost and still be rebuilt with
+// RepairSplit. There can be at most 256 data and parity chunks in total.
+func WriteSplitParity(name string, parity int) (err error) {
+	var sizes []int64
+	for i := 0; ; i++ {
+		stat, err := os.Stat(fmt.Sprintf("%s.%d", name, i))
+		if err != nil {
+			break
+		}
+		sizes = append(sizes, stat.Size())
+	}
+	if len(sizes) == 0 {
+		return os.ErrNotExist
+	}
+	if parity < 1 {
+		return errors.New("volume: there must be at least one parity chunk")
+	}
+	if len(sizes)+parity > 256 {
+		return ErrTooManyChunks
+	}
+	c := &chunkParity{data: len(sizes), parity: parity, sizes: sizes, tag: splitHeaderHash(name)}
+	for _, i := range sizes {
+		if i > c.length {
+			c.length = i
+		}
+	}
+	rs, err := infectious.NewFEC(c.data, c.data+c.parity)
+	if err != nil {
+		return err
+	}
+
+	var files, outputs []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+		for i, f := range outputs {
+			f.Close()
+			if err != nil {
+				os.Remove(fmt.Sprintf("%s.p%d", name, i))
+			}
+		}
+	}()
+	for i := range sizes {
+		f, err := os.Open(fmt.Sprintf("%s.%d", name, i))
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+	}
+	var hashes []hash.Hash
+	for i := 0; i < c.data+c.parity; i++ {
+		hashes = append(hashes, sha3.New256())
+	}
+
+	// The header is written last, once the hashes are known
+	for i := 0; i < parity; i++ {
+		f, err := os.Create(fmt.Sprintf("%s.p%d", name, i))
+		if err != nil {
+			return err
+		}
+		outputs = append(outputs, f)
+		if _, err := f.Seek(c.headerSize(), io.SeekStart); err != nil {
+			return err
+		}
+	}
+	buf := make([]byte, c.data*parityBlock)
+	for offset := int64(0); offset < c.length; offset += parityBlock {
+		size := int64(parityBlock)
+		if c.length-offset < size {
+			size = c.length - offset
+		}
+		stripe := buf[:c.data*int(size)]
+		for i, f := range files {
+			block := stripe[i*int(size) : (i+1)*int(size)]
+			for j := range block {
+				block[j] = 0
+			}
+			n, err := f.ReadAt(block, offset)
+			if err != nil && err != io.EOF {
+				return err
+			}
+			hashes[i].Write(block[:n])
+		}
+		rs.Encode(stripe, func(s infectious.Share) {
+			if s.Number >= c.data && err == nil {
+				hashes[s.Number].Write(s.Data)
+				_, err = outputs[s.Number-c.data].Write(s.Data)
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := range hashes {
+		c.hashes = append(c.hashes, hashes[i].Sum(nil))
+		if i >= c.data {
+			c.sizes = append(c.sizes, c.length)
+		}
+	}
+	for i, f := range outputs {
+		if _, err := f.WriteAt(c.header(i), 0); err != nil {
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	outputs = nil
+	return nil
+}
+
+// RepairSplit rebuilds the chunks of the split volume name that are missing
+// or have the wrong size from its parity chunks. If verify is set, chunks
+// whose contents don't match their hash are rebuilt too, which means reading
+// every chunk. It returns the indexes of the rebuilt chunks, ErrNotParity if
+// there are no parity chunks, and ErrDamaged if too many chunks are lost.
+// Nothing is rebuilt and ErrStaleParity is returned if the volume's header
+// no longer matches the one the parity chunks were made for.
+func RepairSplit(name string, verify bool) ([]int, error) {
+	c, found, err := readChunkParity(name)
+	if err != nil {
+		return nil, err
+	}
+
+	// Find the usable parity chunks and the data chunks that need rebuilding
+	var bad []int
+	for i := 0; i < c.data+c.parity; i++ {
+		path := fmt.Sprintf("%s.%d", name, i)
+		size := c.sizes[i]
+		if i >= c.data {
+			path = fmt.Sprintf("%s.p%d", name, i-c.data)
+			size = c.headerSize() + c.length
+		}
+		stat, err := os.Stat(path)
+		ok := err == nil && stat.Size() == size && c.sizes[i] >= 0 && (i < c.data || found[i-c.data])
+		if ok && verify && c.hashes[i] != nil {
+			if i < c.data {
+				ok = bytes.Equal(fileHash(path), c.hashes[i])
+			} else {
+				// The header isn't part of the hash of a parity chunk
+				f, err := os.Open(path)
+				tmp := sha3.New256()
+				if err == nil {
+					_, err = io.Copy(tmp, io.NewSectionReader(f, c.headerSize(), c.length))
+					f.Close()
+				}
+				ok = err == nil && bytes.Equal(tmp.Sum(nil), c.hashes[i])
+			}
+		}
+		if !ok {
+			bad = append(bad, i)
+		}
+	}
+	var rebuild []int
+	for _, i := range bad {
+		if i < c.data {
+			rebuild = append(rebuild, i)
+		}
+	}
+	if len(rebuild) == 0 {
+		return nil, nil
+	}
+
+	// A rekeyed first chunk would otherwise be "rebuilt" with the old key
+	// slots. The header can only be checked if it can be read.
+	if c.tag != nil {
+		if hash := splitHeaderHash(name); hash != nil && !bytes.Equal(hash, c.tag) {
+			return nil, ErrStaleParity
+		}
+	}
+	if len(bad) > c.parity {
+		return nil, ErrDamaged
+	}
+	for _, i := range rebuild {
+		if c.sizes[i] < 0 {
+			return nil, ErrDamaged // The size of the chunk is unknown
+		}
+	}
+	rs, err := infectious.NewFEC(c.data, c.data+c.parity)
+	if err != nil {
+		return nil, err
+	}
+
+	// Use the first data chunks and parity chunks that are intact
+	var numbers []int
+	var files, outputs []*os.File
+	defer func() {
+		for _, f := range append(files, outputs...) {
+			f.Close()
+		}
+	}()
+	for i := 0; i < c.data+c.parity && len(numbers) < c.data; i++ {
+		usable := true
+		for _, j := range bad {
+			usable = usable && i != j
+		}
+		if !usable {
+			continue
+		}
+		path := fmt.Sprintf("%s.%d", name, i)
+		if i >= c.data {
+			path = fmt.Sprintf("%s.p%d", name, i-c.data)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+		numbers = append(numbers, i)
+	}
+	for _, i := range rebuild {
+		f, err := os.Create(fmt.Sprintf("%s.%d", name, i))
+		if err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, f)
+	}
+
+	// Parity chunks are read past their header
+	rebuilt := make([]hash.Hash, len(rebuild))
+	for i := range rebuilt {
+		rebuilt[i] = sha3.New256()
+	}
+	buf := make([]byte, c.data*parityBlock)
+	for offset := int64(0); offset < c.length; offset += parityBlock {
+		size := int64(parityBlock)
+		if c.length-offset < size {
+			size = c.length - offset
+		}
+		stripe := buf[:c.data*int(size)]
+		shares := make([]infectious.Share, len(files))
+		for i, f := range files {
+			block := stripe[i*int(size) : (i+1)*int(size)]
+			for j := range block {
+				block[j] = 0
+			}
+			start := offset
+			if numbers[i] >= c.data {
+				start += c.headerSize()
+			}
+			if _, err := f.ReadAt(block, start); err != nil && err != io.EOF {
+				return nil, err
+			}
+			shares[i] = infectious.Share{Number: numbers[i], Data: block}
+		}
+		data, err := rs.Decode(nil, shares)
+		if err != nil {
+			return nil, ErrDamaged
+		}
+		for i, j := range rebuild {
+			n := c.sizes[j] - offset
+			if n <= 0 {
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			block := data[j*int(size) : j*int(size)+int(n)]
+			rebuilt[i].Write(block)
+			if _, err := outputs[i].Write(block); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Make sure the chunks were rebuilt correctly
+	for i, j := range rebuild {
+		if c.hashes[j] != nil && !bytes.Equal(rebuilt[i].Sum(nil), c.hashes[j]) {
+			return rebuild, ErrDamaged
+		}
+	}
+	return rebuild, nil
+}
@@ -0,0 +1,230 @@
+package volume
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Encrypt data straight into chunks of a split volume
+func encryptSplit(t *testing.T, name string, data []byte, size int64, limit int) []string {
+	t.Helper()
+	s, err := NewSplitWriter(name, size, limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Encrypt(s, bytes.NewReader(data), &Options{Password: "password", Argon2: &testArgon2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return s.Chunks()
+}
+
+// Decrypt a split volume from its chunks
+func decryptSplit(name string) ([]byte, error) {
+	s, err := NewSplitReader(name)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	var out bytes.Buffer
+	err = Decrypt(&out, s, &Options{Password: "password"})
+	return out.Bytes(), err
+}
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   int64
+		limit  int
+		chunks int
+	}{
+		{"one chunk", int64(4 * MiB), 0, 1},
+		{"several chunks", int64(MiB), 0, 4},
+		{"small chunks", 100000, 0, 32},
+		{"limit", int64(MiB), 2, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := filepath.Join(t.TempDir(), "volume.pcv")
+			data := randomBytes(3 * MiB)
+			chunks := encryptSplit(t, name, data, tt.size, tt.limit)
+			if len(chunks) != tt.chunks {
+				t.Fatalf("made %d chunks, want %d", len(chunks), tt.chunks)
+			}
+			for i, path := range chunks {
+				stat, err := os.Stat(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if i < len(chunks)-1 && stat.Size() != tt.size {
+					t.Errorf("chunk %d is %d bytes, want %d", i, stat.Size(), tt.size)
+				}
+			}
+
+			out, err := decryptSplit(name)
+			if err != nil {
+				t.Fatalf("Decrypt: %v", err)
+			}
+			if !bytes.Equal(out, data) {
+				t.Fatalf("decrypted %d bytes, want the %d encrypted", len(out), len(data))
+			}
+
+			// The chunks can be rekeyed in place
+			f, err := OpenSplitFile(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = Rekey(f, &Options{Password: "password"}, &Options{Password: "password", Argon2: &testArgon2})
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				t.Fatalf("Rekey: %v", err)
+			}
+			if _, err := decryptSplit(name); err != nil {
+				t.Errorf("after Rekey: %v", err)
+			}
+		})
+	}
+}
+
+func TestSplitMissing(t *testing.T) {
+	tests := []struct {
+		name    string
+		parity  int
+		remove  []int
+		err     error
+		rebuilt []int
+	}{
+		{"first chunk", 0, []int{0}, ErrChunkMissing, nil},
+		{"middle chunk", 0, []int{1}, ErrChunkMissing, nil},
+		{"last chunk", 0, []int{3}, ErrModified, nil},
+		{"last chunk with parity", 1, []int{3}, ErrChunkMissing, []int{3}},
+		{"first chunk with parity", 1, []int{0}, ErrChunkMissing, []int{0}},
+		{"two chunks", 2, []int{1, 2}, ErrChunkMissing, []int{1, 2}},
+		{"every parity chunk used", 2, []int{0, 3}, ErrChunkMissing, []int{0, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := filepath.Join(t.TempDir(), "volume.pcv")
+			data := randomBytes(3 * MiB)
+			encryptSplit(t, name, data, int64(MiB), 0)
+			if tt.parity > 0 {
+				if err := WriteSplitParity(name, tt.parity); err != nil {
+					t.Fatalf("WriteSplitParity: %v", err)
+				}
+			}
+			for _, i := range tt.remove {
+				os.Remove(fmt.Sprintf("%s.%d", name, i))
+			}
+			if _, err := decryptSplit(name); err != tt.err {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if tt.parity == 0 {
+				return
+			}
+
+			rebuilt, err := RepairSplit(name, false)
+			if err != nil {
+				t.Fatalf("RepairSplit: %v", err)
+			}
+			if fmt.Sprint(rebuilt) != fmt.Sprint(tt.rebuilt) {
+				t.Errorf("rebuilt %v, want %v", rebuilt, tt.rebuilt)
+			}
+			if out, err := decryptSplit(name); err != nil || !bytes.Equal(out, data) {
+				t.Errorf("after RepairSplit: got %d bytes and %v", len(out), err)
+			}
+		})
+	}
+}
+
+func TestRepairSplit(t *testing.T) {
+	tests := []struct {
+		name    string
+		damage  func(name string)
+		verify  bool
+		rebuilt []int
+		err     error
+	}{
+		{"intact", func(name string) {}, true, nil, nil},
+		{"too many missing", func(name string) {
+			os.Remove(name + ".0")
+			os.Remove(name + ".1")
+			os.Remove(name + ".2")
+		}, false, nil, ErrDamaged},
+		{"missing and parity missing", func(name string) {
+			os.Remove(name + ".1")
+			os.Remove(name + ".2")
+			os.Remove(name + ".p0")
+		}, false, nil, ErrDamaged},
+		{"wrong size", func(name string) {
+			os.Truncate(name+".2", 1000)
+		}, false, []int{2}, nil},
+		{"changed contents", func(name string) {
+			corrupt(name+".2", 5000)
+		}, true, []int{2}, nil},
+		{"changed contents without verify", func(name string) {
+			corrupt(name+".2", 5000)
+		}, false, nil, nil},
+		{"truncated parity", func(name string) {
+			os.Truncate(name+".p0", 300)
+			os.Remove(name + ".1")
+		}, true, []int{1}, nil},
+		{"no parity", func(name string) {
+			os.Remove(name + ".p0")
+			os.Remove(name + ".p1")
+		}, false, nil, ErrNotParity},
+		{"stale parity", func(name string) {
+			f, _ := OpenSplitFile(name)
+			Rekey(f, &Options{Password: "password"}, &Options{Password: "new", Argon2: &testArgon2})
+			f.Close()
+			os.Remove(name + ".3")
+		}, false, nil, ErrStaleParity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := filepath.Join(t.TempDir(), "volume.pcv")
+			encryptSplit(t, name, randomBytes(3*MiB), int64(MiB), 0)
+			if err := WriteSplitParity(name, 2); err != nil {
+				t.Fatalf("WriteSplitParity: %v", err)
+			}
+			tt.damage(name)
+			rebuilt, err := RepairSplit(name, tt.verify)
+			if err != tt.err {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if fmt.Sprint(rebuilt) != fmt.Sprint(tt.rebuilt) {
+				t.Errorf("rebuilt %v, want %v", rebuilt, tt.rebuilt)
+			}
+			if tt.err == nil && tt.verify {
+				if _, err := decryptSplit(name); err != nil {
+					t.Errorf("after RepairSplit: %v", err)
+				}
+			}
+		})
+	}
+
+	name := filepath.Join(t.TempDir(), "volume.pcv")
+	encryptSplit(t, name, randomBytes(1000), 10, 0)
+	if err := WriteSplitParity(name, 200); err != ErrTooManyChunks {
+		t.Errorf("too many chunks: got %v, want ErrTooManyChunks", err)
+	}
+}
+
+// Flip a byte of a file
+func corrupt(path string, offset int64) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	b := make([]byte, 1)
+	f.ReadAt(b, offset)
+	b[0] ^= 1
+	f.WriteAt(b, offset)
+}
@@ -0,0 +1,59 @@
+package volume
+
+import (
+	"errors"
+	"unicode/utf8"
+)
+
+// Tag is a label stored in the header without encryption, so volumes can
+// be indexed before they are decrypted. Tags are covered by the header tag
+// and by signatures, so they can't be changed without it being noticed.
+type Tag struct {
+	Key   string
+	Value string
+}
+
+// Common tag keys, other keys can be used too. Dates are in RFC 3339 format.
+const (
+	TagOwner       = "owner"
+	TagProject     = "project"
+	TagCreated     = "created-at"
+	TagRetention   = "retain-until"
+	TagContentType = "content-type"
+)
+
+// ErrInvalidTag is returned for tags with an empty or overly long key, or
+// text that isn't UTF-8
+var ErrInvalidTag = errors.New("volume: tags need a key of 1 to 255 bytes and UTF-8 text")
+
+// Valid reports whether the tag has a key of 1 to 255 bytes and UTF-8 text
+func (t Tag) Valid() bool {
+	return len(t.Key) > 0 && len(t.Key) <= 255 && utf8.ValidString(t.Key) && utf8.ValidString(t.Value)
+}
+
+// Encode a tag as the length of the key (1 byte), the key, and the value
+func (t Tag) encode() []byte {
+	data := []byte{byte(len(t.Key))}
+	data = append(data, t.Key...)
+	return append(data, t.Value...)
+}
+
+// Decode the tags from entries, skipping other types of entries
+func decodeTags(data []byte) ([]Tag, error) {
+	var tags []Tag
+	err := readEntries(data, func(kind byte, value []byte) error {
+		if kind != entryTag {
+			return nil
+		}
+		if len(value) < 1 || len(value) < 1+int(value[0]) {
+			return ErrHeaderDamaged
+		}
+		t := Tag{string(value[1 : 1+value[0]]), string(value[1+value[0]:])}
+		if !t.Valid() {
+			return ErrHeaderDamaged
+		}
+		tags = append(tags, t)
+		return nil
+	})
+	return tags, err
+}
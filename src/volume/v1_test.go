@@ -0,0 +1,201 @@
+package volume
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"fmt"
+	"hash"
+	"testing"
+
+	"github.com/HACKERALERT/crypto/argon2"
+	"github.com/HACKERALERT/crypto/blake2b"
+	"github.com/HACKERALERT/crypto/chacha20"
+	"github.com/HACKERALERT/crypto/hkdf"
+	"github.com/HACKERALERT/crypto/sha3"
+	"github.com/HACKERALERT/serpent"
+)
+
+// referenceV1 writes a volume the way work() did before v2, step by step,
+// so the package can be checked against it byte for byte
+func referenceV1(data []byte, password string, comments string, paranoid bool, reedsolo bool, h *Header) []byte {
+	var out bytes.Buffer
+	out.Write(rsEncode(rs5, []byte("v1.30")))
+	out.Write(rsEncode(rs5, []byte(fmt.Sprintf("%05d", len(comments)))))
+	for _, i := range []byte(comments) {
+		out.Write(rsEncode(rs1, []byte{i}))
+	}
+	flags := make([]byte, 5)
+	if paranoid {
+		flags[0] = 1
+	}
+	if reedsolo {
+		flags[3] = 1
+	}
+	if len(data)%MiB >= MiB-128 {
+		flags[4] = 1
+	}
+	out.Write(rsEncode(rs5, flags))
+	out.Write(rsEncode(rs16, h.salt))
+	out.Write(rsEncode(rs32, h.hkdfSalt))
+	out.Write(rsEncode(rs16, h.serpentIV))
+	out.Write(rsEncode(rs24, h.nonce))
+	out.Write(make([]byte, 192+96+192))
+
+	a := Argon2Normal
+	if paranoid {
+		a = Argon2Paranoid
+	}
+	key := argon2.IDKey([]byte(password), h.salt, a.Time, a.Memory, a.Threads, 32)
+	tmp := sha3.New512()
+	tmp.Write(key)
+	keyHash := tmp.Sum(nil)
+
+	chacha, _ := chacha20.NewUnauthenticatedCipher(key, h.nonce)
+	var mac hash.Hash
+	subkey := make([]byte, 32)
+	kdf := hkdf.New(sha3.New256, key, h.hkdfSalt, nil)
+	kdf.Read(subkey)
+	if paranoid {
+		mac = hmac.New(sha3.New512, subkey)
+	} else {
+		mac, _ = blake2b.New512(subkey)
+	}
+	serpentKey := make([]byte, 32)
+	kdf.Read(serpentKey)
+	s, _ := serpent.NewCipher(serpentKey)
+	serpentCTR := cipher.NewCTR(s, h.serpentIV)
+
+	for i := 0; i < len(data); i += MiB {
+		src := append([]byte{}, data[i:]...)
+		if len(src) > MiB {
+			src = src[:MiB]
+		}
+		dst := make([]byte, len(src))
+		if paranoid {
+			serpentCTR.XORKeyStream(dst, src)
+			copy(src, dst)
+		}
+		chacha.XORKeyStream(dst, src)
+		mac.Write(dst)
+		if reedsolo {
+			copy(src, dst)
+			dst = nil
+			full := len(src) / 128 * 128
+			for j := 0; j < full; j += 128 {
+				dst = append(dst, rsEncode(rs128, src[j:j+128])...)
+			}
+			if full < MiB {
+				dst = append(dst, rsEncode(rs128, pad(src[full:]))...)
+			}
+		}
+		out.Write(dst)
+	}
+
+	volume := out.Bytes()
+	tail := append(rsEncode(rs64, keyHash), rsEncode(rs32, make([]byte, 32))...)
+	tail = append(tail, rsEncode(rs64, mac.Sum(nil))...)
+	copy(volume[309+len(comments)*3:], tail)
+	return volume
+}
+
+// Encrypt with the package into a volume before v2, which it can still
+// write when given a header with an older version
+func encryptV1(t *testing.T, data []byte, password string, h *Header) []byte {
+	t.Helper()
+	key, keyHash, keyfileHash, err := masterKey(h, &Options{Password: password})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.keyHash, h.keyfileHash = keyHash, keyfileHash
+	f := &memFile{}
+	if err := writeHeader(f, h); err != nil {
+		t.Fatal(err)
+	}
+	v := &Writer{w: f, h: h, c: newCiphers(key, h), buf: make([]byte, 0, MiB), raw: -1}
+	if _, err := v.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return f.data
+}
+
+// A header before v2 with fixed values, so volumes can be compared
+func v1Header(comments string, paranoid bool, reedsolo bool) *Header {
+	return &Header{
+		Version:     "v1.30",
+		Comments:    comments,
+		Paranoid:    paranoid,
+		ReedSolomon: reedsolo,
+		Parity:      8,
+		salt:        bytes.Repeat([]byte{1}, 16),
+		hkdfSalt:    bytes.Repeat([]byte{2}, 32),
+		serpentIV:   bytes.Repeat([]byte{3}, 16),
+		nonce:       bytes.Repeat([]byte{4}, 24),
+	}
+}
+
+var v1Tests = []struct {
+	name     string
+	size     int
+	comments string
+	paranoid bool
+	reedsolo bool
+}{
+	{"empty", 0, "", false, false},
+	{"small", 1000, "", false, false},
+	{"several chunks", 2*MiB + 300, "", false, false},
+	{"comments", 1000, "public comments", false, false},
+	{"paranoid", MiB + 1, "", true, false},
+	{"reed-solomon", MiB + 200, "", false, true},
+	{"reed-solomon padded", MiB - 100, "", false, true},
+	{"reed-solomon full chunk", MiB, "", false, true},
+	{"paranoid reed-solomon", 5000, "comments", true, true},
+}
+
+func TestV1Identical(t *testing.T) {
+	for _, tt := range v1Tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := randomBytes(tt.size)
+			h := v1Header(tt.comments, tt.paranoid, tt.reedsolo)
+			want := referenceV1(data, "password", tt.comments, tt.paranoid, tt.reedsolo, h)
+			if got := encryptV1(t, data, "password", h); !bytes.Equal(got, want) {
+				t.Fatalf("volume differs from the one work() wrote (%d bytes, want %d)", len(got), len(want))
+			}
+		})
+	}
+}
+
+func TestV1RoundTrip(t *testing.T) {
+	for _, tt := range v1Tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := randomBytes(tt.size)
+			h := v1Header(tt.comments, tt.paranoid, tt.reedsolo)
+			f := &memFile{data: referenceV1(data, "password", tt.comments, tt.paranoid, tt.reedsolo, h)}
+			out, err := decrypt(f, &Options{Password: "password"})
+			if err != nil {
+				t.Fatalf("Decrypt: %v", err)
+			}
+			if !bytes.Equal(out, data) {
+				t.Fatalf("decrypted %d bytes, want the %d encrypted", len(out), len(data))
+			}
+			if h := readHeader(t, f); h.Comments != tt.comments || h.Paranoid != tt.paranoid || h.ReedSolomon != tt.reedsolo {
+				t.Errorf("header is %+v", h)
+			}
+			if _, err := decrypt(f, &Options{Password: "wrong"}); err != ErrIncorrectPassword {
+				t.Errorf("wrong password: got %v, want ErrIncorrectPassword", err)
+			}
+
+			// The whole volume is authenticated at the end, though Reed-Solomon
+			// would correct a changed byte
+			if tt.size > 0 && !tt.reedsolo {
+				f.data[len(f.data)-1] ^= 1
+				if _, err := decrypt(f, &Options{Password: "password"}); err != ErrModified {
+					t.Errorf("tampered: got %v, want ErrModified", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,288 @@
+// Package volume reads and writes Picocrypt volumes (.pcv files).
+//
+// This is the same code that the Picocrypt GUI uses, so volumes written
+// here are identical to the ones written by the app and vice versa. See
+// Internals.md for a description of the format.
+package volume
+
+import (
+	"crypto/subtle"
+	"errors"
+	"io"
+	"math/bits"
+	"os"
+	"time"
+
+	"github.com/HACKERALERT/crypto/argon2"
+	"github.com/HACKERALERT/crypto/sha3"
+)
+
+// Version is written into the header of new volumes
+const Version = "v2.00"
+
+// Constants
+var MiB = 1 << 20
+var GiB = 1 << 30
+
+// Errors that can occur while decrypting
+var (
+	ErrNotVolume         = errors.New("volume: not a Picocrypt volume")
+	ErrHeaderDamaged     = errors.New("volume: the volume header is damaged")
+	ErrHeaderModified    = errors.New("volume: the volume header has been tampered with")
+	ErrKeyfilesRequired  = errors.New("volume: keyfiles are required")
+	ErrIncorrectPassword = errors.New("volume: the provided password is incorrect")
+	ErrIncorrectKeyfiles = errors.New("volume: incorrect keyfiles")
+	ErrIncorrectIdentity = errors.New("volume: none of the identities can decrypt the volume")
+	ErrDamaged           = errors.New("volume: the input file is irrecoverably damaged")
+	ErrModified          = errors.New("volume: the input file is damaged or modified")
+)
+
+// Options used when encrypting or decrypting a volume
+type Options struct {
+	Password string
+	Keyfiles []string // Paths to the keyfiles, in order
+
+	// Only used when encrypting, decryption reads these from the header
+	KeyfileOrdered bool      // Require the correct order of keyfiles
+	Comments       string    // Stored in the header without encryption
+	Notes          string    // Encrypted comments, only readable with the key
+	Tags           []Tag     // Labels stored in the header without encryption
+	Paranoid       bool      // Cascade XChaCha20 with Serpent and use HMAC-SHA3
+	ReedSolomon    bool      // Encode the encrypted data with Reed-Solomon
+	Parity         int       // Reed-Solomon parity bytes per 128 bytes of data: 8 (default), 16, 32, or 64
+	Recipients     [][]byte  // X25519 public keys that can decrypt without the password
+	Keys           []Key     // More passwords that can decrypt, like a recovery password
+	Argon2         *Argon2   // Key derivation parameters (nil for the defaults of the mode)
+	Signer         []byte    // Ed25519 signing key to sign the volume with
+	Detached       bool      // Don't embed the signature, get it from Writer.Signature
+	Padding        int64     // Random bytes to add after the data, which hide its size
+	PadScheme      int       // Round the padded size up with PadPadme or PadBucket
+	Hidden         *Hidden   // A volume to hide at the end of the padding
+	Metadata       *Metadata // Encrypted name, mode, and time of the original file
+
+	// Only used when decrypting
+	Force      bool     // Keep going if the volume is damaged or modified
+	FastDecode bool     // Don't correct Reed-Solomon blocks (retry without on ErrModified)
+	Identities [][]byte // X25519 private keys to try before the password
+}
+
+// Length-hiding padding schemes, which round up the size of the data and
+// padding so volumes of similar sizes can't be told apart
+const (
+	PadNone   = iota
+	PadPadme  // Padmé, which adds at most 12% and hides all but O(log log n) bits of the size
+	PadBucket // The next power of two, which adds at most 100%
+)
+
+// Round size up with a length-hiding padding scheme
+func padSize(size int64, scheme int) int64 {
+	if size < 2 {
+		return size
+	}
+	switch scheme {
+	case PadPadme:
+		// Keep only the top log2(log2(size)) + 1 bits of the size
+		e := bits.Len64(uint64(size)) - 1
+		s := bits.Len64(uint64(e))
+		mask := int64(1)<<(e-s) - 1
+		return (size + mask) &^ mask
+	case PadBucket:
+		return int64(1) << bits.Len64(uint64(size-1))
+	}
+	return size
+}
+
+// Key is a password and keyfiles that can open a volume in addition to the
+// ones in Options, each stored in its own key slot
+type Key struct {
+	Password       string
+	Keyfiles       []string // Paths to the keyfiles, in order
+	KeyfileOrdered bool     // Require the correct order of keyfiles
+}
+
+// Argon2 holds the Argon2id parameters used to derive keys from passwords.
+// Since v2 they are stored in each password slot.
+type Argon2 struct {
+	Time    uint32 // Number of passes
+	Memory  uint32 // Memory in KiB
+	Threads uint8
+}
+
+// Presets for the Argon2id parameters
+var (
+	Argon2Normal   = Argon2{4, 1 << 20, 4} // 4 passes, 1 GiB memory, 4 threads
+	Argon2Paranoid = Argon2{8, 1 << 20, 8} // 8 passes, 1 GiB memory, 8 threads
+	Argon2Low      = Argon2{8, 1 << 18, 4} // 8 passes, 256 MiB memory, 4 threads
+	Argon2Strong   = Argon2{4, 1 << 21, 8} // 4 passes, 2 GiB memory, 8 threads
+)
+
+// Limits on the parameters, since they are read from the header before the
+// password is checked and a crafted volume could otherwise ask for absurd
+// resources
+const (
+	MaxArgon2Time   = 64
+	MaxArgon2Memory = 1 << 21 // 2 GiB, the Strong preset
+
+	// Passes times KiB of memory, which is 16 passes of 1 GiB or twice the
+	// Paranoid preset. The password slots are tried one after another, so
+	// there can only be a few of them, and together they can't ask for more
+	// work than this either
+	MaxArgon2Work    = 16 << 20
+	MaxPasswordSlots = 16
+)
+
+// Errors for parameters outside the limits
+var (
+	ErrInvalidArgon2    = errors.New("volume: invalid Argon2 parameters")
+	ErrTooManyPasswords = errors.New("volume: too many passwords")
+)
+
+// Valid reports whether the parameters are within the limits
+func (a Argon2) Valid() bool {
+	return a.Time >= 1 && a.Time <= MaxArgon2Time &&
+		a.Threads >= 1 && a.Memory >= 8*uint32(a.Threads) && a.Memory <= MaxArgon2Memory &&
+		a.work() <= MaxArgon2Work
+}
+
+// The work of deriving a key, in passes times KiB of memory
+func (a Argon2) work() uint64 {
+	return uint64(a.Time) * uint64(a.Memory)
+}
+
+// Get the parameters to encrypt with, which default to those of older volumes
+func argon2Params(custom *Argon2, paranoid bool) (Argon2, error) {
+	a := Argon2Normal
+	if custom != nil {
+		a = *custom
+	} else if paranoid {
+		a = Argon2Paranoid
+	}
+	if !a.Valid() {
+		return a, ErrInvalidArgon2
+	}
+	return a, nil
+}
+
+// CalibrateArgon2 returns parameters with the given memory and threads that
+// take about target to derive a key on this machine
+func CalibrateArgon2(memory uint32, threads uint8, target time.Duration) Argon2 {
+	a := Argon2{1, memory, threads}
+	if elapsed := BenchmarkArgon2(a); elapsed > 0 {
+		passes := int64(target / elapsed)
+		if passes > MaxArgon2Time {
+			passes = MaxArgon2Time
+		}
+		if memory > 0 && passes > int64(MaxArgon2Work/uint64(memory)) {
+			passes = int64(MaxArgon2Work / uint64(memory))
+		}
+		if passes > 1 {
+			a.Time = uint32(passes)
+		}
+	}
+	return a
+}
+
+// Derive the encryption key from the password with Argon2id
+func deriveKey(password string, salt []byte, a Argon2) []byte {
+	return argon2.IDKey(
+		[]byte(password),
+		salt,
+		a.Time,
+		a.Memory,
+		a.Threads,
+		32, // 32-byte output key
+	)
+}
+
+// Hash the keyfiles into a key and get a hash of that key for comparison
+func keyfileKey(paths []string, ordered bool) ([]byte, []byte, error) {
+	var key []byte
+	if ordered { // If order matters, hash progressively
+		tmp := sha3.New256()
+		for _, path := range paths {
+			if err := hashFile(tmp, path); err != nil {
+				return nil, nil, err
+			}
+		}
+		key = tmp.Sum(nil)
+	} else { // If order doesn't matter, hash individually and combine
+		for _, path := range paths {
+			tmp := sha3.New256()
+			if err := hashFile(tmp, path); err != nil {
+				return nil, nil, err
+			}
+			sum := tmp.Sum(nil)
+
+			// XOR keyfile hash with 'key'
+			if key == nil {
+				key = sum
+			} else {
+				for i, j := range sum {
+					key[i] ^= j
+				}
+			}
+		}
+	}
+
+	// Store a hash of 'key' for comparison
+	tmp := sha3.New256()
+	tmp.Write(key)
+	return key, tmp.Sum(nil), nil
+}
+
+// Write the contents of a file into a hash
+func hashFile(w io.Writer, path string) error {
+	fin, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fin.Close()
+	_, err = io.Copy(w, fin)
+	return err
+}
+
+// Get the key used for encryption along with the hashes stored in the header
+func masterKey(h *Header, opts *Options) ([]byte, []byte, []byte, error) {
+	k := Key{opts.Password, opts.Keyfiles, h.KeyfileOrdered}
+	a := Argon2Normal
+	if h.Paranoid {
+		a = Argon2Paranoid
+	}
+	return passwordKey(k, h.salt, a, h.Keyfiles)
+}
+
+// Derive a key from the password and keyfiles along with the hashes used to check them
+func passwordKey(k Key, salt []byte, a Argon2, keyfiles bool) ([]byte, []byte, []byte, error) {
+	key := deriveKey(k.Password, salt, a)
+
+	// Hash the encryption key for comparison when decrypting
+	tmp := sha3.New512()
+	tmp.Write(key)
+	keyHash := tmp.Sum(nil)
+
+	// XOR the encryption key with the keyfile key
+	keyfileHash := make([]byte, 32)
+	if keyfiles {
+		var kkey []byte
+		var err error
+		kkey, keyfileHash, err = keyfileKey(k.Keyfiles, k.KeyfileOrdered)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		for i := range key {
+			key[i] ^= kkey[i]
+		}
+	}
+	return key, keyHash, keyfileHash, nil
+}
+
+// Check the password and keyfiles against the hashes in the header
+func checkKey(h *Header, keyHash []byte, keyfileHash []byte) error {
+	if subtle.ConstantTimeCompare(keyHash, h.keyHash) != 1 {
+		return ErrIncorrectPassword
+	}
+	if h.Keyfiles && subtle.ConstantTimeCompare(keyfileHash, h.keyfileHash) != 1 {
+		return ErrIncorrectKeyfiles
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+package volume
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Cheap Argon2 parameters so each key takes milliseconds instead of 1 GiB
+var testArgon2 = Argon2{1, 64, 1}
+
+func TestMain(m *testing.M) {
+	// Volumes before v2 and slots without parameters use the presets
+	Argon2Normal = testArgon2
+	Argon2Paranoid = Argon2{2, 64, 2}
+	os.Exit(m.Run())
+}
+
+// memFile is an in-memory file that can be read, written, seeked, and truncated
+type memFile struct {
+	data []byte
+	pos  int64
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	if f.pos >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data[f.pos:])
+	f.pos += int64(n)
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	if end := f.pos + int64(len(p)); end > int64(len(f.data)) {
+		f.data = append(f.data, make([]byte, end-int64(len(f.data)))...)
+	}
+	copy(f.data[f.pos:], p)
+	f.pos += int64(len(p))
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += int64(len(f.data))
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.data = f.data[:size]
+	return nil
+}
+
+func randomBytes(n int) []byte {
+	data := make([]byte, n)
+	rand.Read(data)
+	return data
+}
+
+// Encrypt data into a new in-memory volume
+func encrypt(t *testing.T, data []byte, opts *Options) *memFile {
+	t.Helper()
+	f := &memFile{}
+	if err := Encrypt(f, bytes.NewReader(data), opts); err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	f.pos = 0
+	return f
+}
+
+// Decrypt a volume from the start
+func decrypt(f *memFile, opts *Options) ([]byte, error) {
+	var out bytes.Buffer
+	err := Decrypt(&out, bytes.NewReader(f.data), opts)
+	return out.Bytes(), err
+}
+
+func TestRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	keyfile := filepath.Join(dir, "keyfile")
+	if err := os.WriteFile(keyfile, randomBytes(100), 0600); err != nil {
+		t.Fatal(err)
+	}
+	meta := &Metadata{Name: "file.txt", Mode: 0640, ModTime: time.Unix(1700000000, 0)}
+
+	tests := []struct {
+		name string
+		size int
+		opts Options
+	}{
+		{"empty", 0, Options{}},
+		{"small", 1000, Options{}},
+		{"one chunk", MiB, Options{}},
+		{"several chunks", 2*MiB + 300, Options{}},
+		{"paranoid", MiB + 1, Options{Paranoid: true}},
+		{"reed-solomon", MiB + 200, Options{ReedSolomon: true}},
+		{"reed-solomon padded", MiB - 100, Options{ReedSolomon: true}},
+		{"reed-solomon parity 32", 5000, Options{ReedSolomon: true, Parity: 32}},
+		{"keyfiles", 1000, Options{Keyfiles: []string{keyfile}, KeyfileOrdered: true}},
+		{"comments, notes, and tags", 1000, Options{Comments: "public", Notes: "secret", Tags: []Tag{{TagOwner, "me"}}}},
+		{"metadata", 1000, Options{Metadata: meta}},
+		{"padding", 1000, Options{Padding: 5000, PadScheme: PadPadme}},
+		{"recipient", 1000, Options{Recipients: [][]byte{mustRecipient(t, testIdentity)}}},
+		{"several passwords", 1000, Options{Keys: []Key{{Password: "recovery"}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := randomBytes(tt.size)
+			opts := tt.opts
+			opts.Password = "password"
+			opts.Argon2 = &testArgon2
+			f := encrypt(t, data, &opts)
+			if size := EncryptedSize(int64(tt.size), &opts); size != int64(len(f.data)) {
+				t.Errorf("EncryptedSize = %d, volume is %d bytes", size, len(f.data))
+			}
+
+			v, err := NewReader(bytes.NewReader(f.data), &Options{Password: "password", Keyfiles: opts.Keyfiles})
+			if err != nil {
+				t.Fatalf("NewReader: %v", err)
+			}
+			out, err := io.ReadAll(v)
+			if err != nil {
+				t.Fatalf("Read: %v", err)
+			}
+			if !bytes.Equal(out, data) {
+				t.Fatalf("decrypted %d bytes, want the %d encrypted", len(out), len(data))
+			}
+			if v.Notes() != opts.Notes {
+				t.Errorf("Notes = %q, want %q", v.Notes(), opts.Notes)
+			}
+			if h := v.Header(); h.Comments != opts.Comments || len(h.Tags) != len(opts.Tags) {
+				t.Errorf("header has comments %q and tags %v", h.Comments, h.Tags)
+			}
+			if opts.Metadata != nil && (v.Metadata() == nil || *v.Metadata() != *meta) {
+				t.Errorf("Metadata = %v, want %v", v.Metadata(), meta)
+			}
+		})
+	}
+}
+
+func TestIncorrectKeys(t *testing.T) {
+	dir := t.TempDir()
+	keyfile := filepath.Join(dir, "keyfile")
+	other := filepath.Join(dir, "other")
+	os.WriteFile(keyfile, randomBytes(100), 0600)
+	os.WriteFile(other, randomBytes(100), 0600)
+	f := encrypt(t, randomBytes(1000), &Options{Password: "password", Keyfiles: []string{keyfile}, Argon2: &testArgon2})
+
+	tests := []struct {
+		name string
+		opts Options
+		err  error
+	}{
+		{"wrong password", Options{Password: "wrong", Keyfiles: []string{keyfile}}, ErrIncorrectPassword},
+		{"no keyfiles", Options{Password: "password"}, ErrKeyfilesRequired},
+		{"wrong keyfiles", Options{Password: "password", Keyfiles: []string{other}}, ErrIncorrectKeyfiles},
+		{"wrong identity", Options{Identities: [][]byte{testIdentity}}, ErrIncorrectIdentity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decrypt(f, &tt.opts); err != tt.err {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+// A fixed identity so the tests don't depend on a random one being valid
+var testIdentity = bytes.Repeat([]byte{7}, 32)
+
+func mustRecipient(t *testing.T, identity []byte) []byte {
+	t.Helper()
+	recipient, err := Recipient(identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return recipient
+}
+
+// Read the header of an in-memory volume
+func readHeader(t *testing.T, f *memFile) *Header {
+	t.Helper()
+	h, err := ReadHeader(bytes.NewReader(f.data))
+	if err != nil {
+		t.Fatalf("ReadHeader: %v", err)
+	}
+	return h
+}
+
+func TestInvalidOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		opts Options
+		err  error
+	}{
+		{"parity", Options{ReedSolomon: true, Parity: 12}, ErrInvalidParity},
+		{"argon2", Options{Argon2: &Argon2{0, 64, 1}}, ErrInvalidArgon2},
+		{"argon2 memory", Options{Argon2: &Argon2{1, MaxArgon2Memory + 1, 1}}, ErrInvalidArgon2},
+		{"argon2 work", Options{Argon2: &Argon2{MaxArgon2Time, MaxArgon2Memory, 1}}, ErrInvalidArgon2},
+		{"tag", Options{Tags: []Tag{{"", "value"}}}, ErrInvalidTag},
+		{"padding", Options{Padding: -1}, ErrInvalidPadding},
+		{"hidden", Options{Padding: 100, Hidden: &Hidden{Size: 1000}}, ErrHiddenTooLarge},
+		{"passwords", Options{Argon2: &testArgon2, Keys: make([]Key, MaxPasswordSlots)}, ErrTooManyPasswords},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.Password = "password"
+			if _, err := NewWriter(&memFile{}, &tt.opts); err != tt.err {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+}